@@ -1,8 +1,10 @@
 package main
 
 import (
+	"context"
 	"crypto/sha256"
 	"encoding/hex"
+	"flag"
 	"fmt"
 	"io"
 	"log"
@@ -12,23 +14,37 @@ import (
 	"strconv"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/boxy-pug/httpfromtcp/internal/headers"
 	"github.com/boxy-pug/httpfromtcp/internal/request"
 	"github.com/boxy-pug/httpfromtcp/internal/response"
+	"github.com/boxy-pug/httpfromtcp/internal/router"
 	"github.com/boxy-pug/httpfromtcp/internal/server"
 )
 
-const port = 42069
+const (
+	// How long requests in flight get to finish after SIGINT or SIGTERM
+	shutdownTimeout = 10 * time.Second
+	// How long a new process started on SIGUSR2 gets to take over the listener
+	upgradeTimeout = 30 * time.Second
+	// How often certificate files are checked for changes
+	certWatchInterval = 10 * time.Second
+)
 
 func main() {
+	addr := flag.String("addr", server.DefaultAddr, "address to listen on, e.g. :42069 for all interfaces or a socket path")
+	network := flag.String("network", server.DefaultNetwork, "network to listen on: tcp, tcp4, tcp6 or unix (a path starting with @ is an abstract socket)")
+	socketMode := flag.Uint("socket-mode", 0, "permissions of the unix socket file, e.g. 0660")
+	certFiles := flag.String("cert", "", "comma separated TLS certificate files to serve HTTPS, picked by SNI with the first as default")
+	keyFiles := flag.String("key", "", "comma separated private key files, one per certificate")
+	clientCAs := flag.String("client-ca", "", "comma separated CA files to verify client certificates against")
+	clientAuth := flag.String("client-auth", "require-and-verify", "client certificate policy with -client-ca: none, request, require, verify-if-given or require-and-verify")
+	flag.Parse()
 
-	// Instantiate your handler function
-	myHandler := func(w *response.Writer, req *request.Request) {
-		// Check request path and handle appropriately
-		switch req.RequestLine.RequestTarget {
-		case "/":
-			body := `<html>
+	// Routes by method and path; unknown paths get a 404 and other methods a 405
+	r := router.New()
+	r.Get("/", htmlPage(response.OK, `<html>
   <head>
     <title>200 OK</title>
   </head>
@@ -36,16 +52,8 @@ func main() {
     <h1>Success!</h1>
     <p>Your request was an absolute banger.</p>
   </body>
-</html>`
-			w.WriteStatusLine(response.OK)
-			w.WriteHeaders(headers.Headers{
-				"Content-Type":   "text/html",
-				"Content-Length": strconv.Itoa(len(body)),
-			})
-			w.WriteBody([]byte(body))
-
-		case "/yourproblem":
-			body := `<html>
+</html>`))
+	r.Get("/yourproblem", htmlPage(response.BadRequest, `<html>
   <head>
     <title>400 Bad Request</title>
   </head>
@@ -53,16 +61,8 @@ func main() {
     <h1>Bad Request</h1>
     <p>Your request honestly kinda sucked.</p>
   </body>
-</html>`
-			w.WriteStatusLine(response.BadRequest)
-			w.WriteHeaders(headers.Headers{
-				"Content-Type":   "text/html",
-				"Content-Length": strconv.Itoa(len(body)),
-			})
-			w.WriteBody([]byte(body))
-
-		case "/myproblem":
-			body := `<html>
+</html>`))
+	r.Get("/myproblem", htmlPage(response.InternalError, `<html>
   <head>
     <title>500 Internal Server Error</title>
   </head>
@@ -70,102 +70,195 @@ func main() {
     <h1>Internal Server Error</h1>
     <p>Okay, you know what? This one is on me.</p>
   </body>
-</html>`
-			w.WriteStatusLine(response.InternalError)
-			w.WriteHeaders(headers.Headers{
-				"Content-Type":   "text/html",
-				"Content-Length": strconv.Itoa(len(body)),
-			})
-			w.WriteBody([]byte(body))
-		default:
-			if strings.HasPrefix(req.RequestLine.RequestTarget, "/httpbin") {
-				path := strings.TrimPrefix(req.RequestLine.RequestTarget, "/httpbin/")
-				targetURL := fmt.Sprintf("https://httpbin.org/%s", path)
-
-				proxyReq, err := http.NewRequest("GET", targetURL, nil)
-				if err != nil {
-					fmt.Println("Error making request to httpbin: ", err)
-					return
-				}
-				// Make the proxy request
-				resp, err := http.DefaultClient.Do(proxyReq)
-				if err != nil {
-					fmt.Println("Error making request to httpbin:", err)
-					return
-				}
-				defer resp.Body.Close()
-
-				w.Headers = headers.NewHeaders()
-				w.WriteStatusLine(response.OK)
-
-				w.Headers.Remove("Content-Length")
-
-				w.WriteHeaders(headers.Headers{
-					"Transfer-Encoding": "chunked",          // Clearly states chunks are coming
-					"Content-Type":      "application/json", // Expected from httpbin
-					"Trailer":           "X-Content-Sha256, X-Content-Length",
-				})
-
-				var fullBody []byte
-				buf := make([]byte, 100) // Adjust buffer size if needed
-				for {
-					n, err := resp.Body.Read(buf)
-					if n > 0 {
-						fullBody = append(fullBody, buf[:n]...)
-						fmt.Printf("Chunk to write: %q, size: %d\n", buf[:n], n)
-						if _, writeErr := w.WriteChunkedBody(buf[:n]); writeErr != nil {
-							fmt.Println("Error writing chunk:", writeErr)
-							return
-						}
-					}
-					if err != nil {
-						if err == io.EOF {
-							break // End of response body
-						}
-						fmt.Println("Error reading response body:", err)
-						return
-					}
-				}
-				// Signal end of chunked response
-				if _, err := w.WriteChunkedBodyDone(); err != nil {
-					fmt.Println("Error finishing chunked response:", err)
-				}
-
-				// Calculate SHA256 hash and content length
-				hash := sha256.Sum256(fullBody)
-				hashString := hex.EncodeToString(hash[:])
-				contentLength := strconv.Itoa(len(fullBody))
-
-				// Write trailers
-				w.WriteTrailers(headers.Headers{
-					"X-Content-Sha256": hashString,
-					"X-Content-Length": contentLength,
-				})
+</html>`))
+	r.Get("/httpbin/{path...}", proxyHttpbin)
 
-			} else {
-				// Write a default response to the writer
-				w.WriteStatusLine(response.BadRequest)
-				return
-			}
+	// Create the server with the custom handler
+	opts := []server.Option{
+		server.WithNetwork(*network),
+		server.WithAddr(*addr),
+		server.WithUnixSocketMode(os.FileMode(*socketMode)),
+		server.WithErrorHandler(r.ServeRequest),
+		server.WithReadHeaderTimeout(10 * time.Second),
+		server.WithWriteTimeout(time.Minute), // The httpbin proxy streams, leave it some room
+	}
 
+	// Certificates are reloaded on SIGHUP and whenever the files change
+	var certs *server.CertStore
+	if *certFiles != "" {
+		var err error
+		certs, err = loadCerts(*certFiles, *keyFiles)
+		if err != nil {
+			log.Fatalf("Error loading certificates: %v", err)
 		}
+		tlsConfig := certs.TLSConfig()
+		if *clientCAs != "" {
+			if tlsConfig.ClientCAs, err = server.LoadCertPool(strings.Split(*clientCAs, ",")...); err != nil {
+				log.Fatalf("Error loading client CAs: %v", err)
+			}
+			if tlsConfig.ClientAuth, err = server.ParseClientAuth(*clientAuth); err != nil {
+				log.Fatal(err)
+			}
+		}
+		opts = append(opts, server.WithTLSConfig(tlsConfig))
 
+		watchCtx, stopWatch := context.WithCancel(context.Background())
+		defer stopWatch()
+		go certs.Watch(watchCtx, certWatchInterval, func(err error) {
+			log.Printf("Error reloading certificates: %v", err)
+		})
 	}
+	s := server.New(opts...)
 
-	// Create the server with the custom handler
-	s := &server.Server{
-		Handler: myHandler,
+	// Take over a socket from systemd or from the process we replace, if given one
+	listeners, err := server.InheritedListeners()
+	if err != nil {
+		log.Fatalf("Error inheriting listener: %v", err)
+	}
+	if len(listeners) > 0 {
+		err = s.ServeListener(listeners[0])
+	} else {
+		err = s.Listen()
 	}
-
-	httpServer, err := server.Serve(port, s.Handler)
 	if err != nil {
 		log.Fatalf("Error starting server: %v", err)
 	}
-	defer httpServer.Close()
-	log.Println("Server started on port", port)
+	log.Println("Server started on", s.Listener.Addr())
+	if err := server.NotifyReady(); err != nil {
+		log.Printf("Error reporting readiness: %v", err)
+	}
 
+	// SIGUSR2 hands the listener to a freshly started copy of the binary, e.g. after a deploy
 	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
-	<-sigChan
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGUSR2, syscall.SIGHUP)
+	for sig := range sigChan {
+		if sig == syscall.SIGHUP {
+			if certs == nil {
+				continue
+			}
+			if err := certs.Reload(); err != nil {
+				log.Printf("Error reloading certificates: %v", err)
+			} else {
+				log.Println("Certificates reloaded")
+			}
+			continue
+		}
+		if sig != syscall.SIGUSR2 {
+			break
+		}
+		log.Println("Starting new process to take over")
+		ctx, cancel := context.WithTimeout(context.Background(), upgradeTimeout)
+		err := s.Upgrade(ctx)
+		cancel()
+		if err == nil {
+			log.Println("New process is ready, draining")
+			break
+		}
+		log.Printf("Error upgrading, carrying on: %v", err)
+	}
+	// A second signal skips the wait for requests in flight
+	signal.Stop(sigChan)
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		log.Printf("Error shutting down server: %v", err)
+	}
 	log.Println("Server gracefully stopped")
 }
+
+// Pairs up the comma separated -cert and -key flags.
+func loadCerts(certFiles, keyFiles string) (*server.CertStore, error) {
+	certs := strings.Split(certFiles, ",")
+	keys := strings.Split(keyFiles, ",")
+	if len(certs) != len(keys) {
+		return nil, fmt.Errorf("%d certificates but %d keys", len(certs), len(keys))
+	}
+	files := make([]server.CertificateFiles, len(certs))
+	for i := range certs {
+		files[i] = server.CertificateFiles{CertFile: certs[i], KeyFile: keys[i]}
+	}
+	return server.NewCertStore(files...)
+}
+
+// Returns a handler that answers with a fixed HTML page.
+func htmlPage(statusCode response.StatusCode, body string) server.ErrorHandler {
+	return func(w *response.Writer, req *request.Request) error {
+		w.WriteStatusLine(statusCode)
+		h := response.GetDefaultHeaders(len(body))
+		h.Set("Content-Type", "text/html")
+		w.WriteHeaders(h)
+		_, err := w.WriteBody([]byte(body))
+		return err
+	}
+}
+
+// Streams the httpbin.org resource named by the rest of the path back as a chunked body,
+// with its SHA-256 and length as trailers.
+func proxyHttpbin(w *response.Writer, req *request.Request) error {
+	// The raw path keeps the client's percent-encoding, PathValue would be decoded
+	path := strings.TrimPrefix(req.URL.RawPath, "/httpbin/")
+	targetURL := fmt.Sprintf("https://httpbin.org/%s", path)
+	if req.URL.RawQuery != "" {
+		targetURL += "?" + req.URL.RawQuery
+	}
+
+	// Tied to the request so the upstream call stops once the client hangs up
+	proxyReq, err := http.NewRequestWithContext(req.Context(), "GET", targetURL, nil)
+	if err != nil {
+		return &server.HandlerError{StatusCode: response.BadRequest, Message: "invalid httpbin path"}
+	}
+	// Make the proxy request
+	resp, err := http.DefaultClient.Do(proxyReq)
+	if err != nil {
+		fmt.Println("Error making request to httpbin:", err)
+		return &server.HandlerError{StatusCode: response.BadGateway, Message: "httpbin is unreachable"}
+	}
+	defer resp.Body.Close()
+
+	w.WriteStatusLine(response.OK)
+
+	h := headers.NewHeaders()
+	h.Set("Transfer-Encoding", "chunked")     // Clearly states chunks are coming
+	h.Set("Content-Type", "application/json") // Expected from httpbin
+	h.Set("Trailer", "X-Content-Sha256, X-Content-Length")
+	w.WriteHeaders(h)
+
+	var fullBody []byte
+	buf := make([]byte, 100) // Adjust buffer size if needed
+	for {
+		n, err := resp.Body.Read(buf)
+		if n > 0 {
+			fullBody = append(fullBody, buf[:n]...)
+			fmt.Printf("Chunk to write: %q, size: %d\n", buf[:n], n)
+			if _, writeErr := w.WriteChunkedBody(buf[:n]); writeErr != nil {
+				return fmt.Errorf("writing chunk: %w", writeErr)
+			}
+			// Push each chunk out as it arrives instead of waiting for the buffer to fill
+			if flushErr := w.Flush(); flushErr != nil {
+				return fmt.Errorf("flushing chunk: %w", flushErr)
+			}
+		}
+		if err != nil {
+			if err == io.EOF {
+				break // End of response body
+			}
+			return fmt.Errorf("reading httpbin response: %w", err)
+		}
+	}
+	// Signal end of chunked response
+	if _, err := w.WriteChunkedBodyDone(); err != nil {
+		fmt.Println("Error finishing chunked response:", err)
+	}
+
+	// Calculate SHA256 hash and content length
+	hash := sha256.Sum256(fullBody)
+	hashString := hex.EncodeToString(hash[:])
+	contentLength := strconv.Itoa(len(fullBody))
+
+	// Write trailers
+	trailers := headers.NewHeaders()
+	trailers.Set("X-Content-Sha256", hashString)
+	trailers.Set("X-Content-Length", contentLength)
+	return w.WriteTrailers(trailers)
+}
@@ -47,9 +47,10 @@ func main() {
 func printToConsole(request *request.Request) {
 	fmt.Printf("- Request line:\n- Method: %s\n- Target: %s\n- Version: %s\n", request.RequestLine.Method, request.RequestLine.RequestTarget, request.RequestLine.HttpVersion)
 	fmt.Println("Headers:")
-	for key, val := range request.Headers {
+	request.Headers.Range(func(key, val string) bool {
 		fmt.Printf("- %s: %s\n", key, val)
-	}
+		return true
+	})
 	fmt.Println("Body:")
 	fmt.Println(string(request.Body))
 }
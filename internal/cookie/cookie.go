@@ -0,0 +1,169 @@
+package cookie
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Date format for the Expires attribute (IMF-fixdate)
+const timeFormat = "Mon, 02 Jan 2006 15:04:05 GMT"
+
+type SameSite int
+
+const (
+	SameSiteDefault SameSite = iota // Attribute left out, the browser decides
+	SameSiteLax
+	SameSiteStrict
+	SameSiteNone
+)
+
+// A cookie as sent by the client in a Cookie header (only Name and Value are set)
+// or by the server in a Set-Cookie header.
+type Cookie struct {
+	Name  string
+	Value string
+
+	Path    string
+	Domain  string
+	Expires time.Time // Zero means no Expires attribute
+	// Zero means no Max-Age attribute. Negative means delete the cookie now and is sent as Max-Age=0.
+	MaxAge      int
+	Secure      bool
+	HttpOnly    bool
+	SameSite    SameSite
+	Partitioned bool
+}
+
+// Parses the value of a Cookie request header ("a=1; b=2"). Pairs that aren't valid are
+// skipped rather than failing the whole header, since browsers happily send junk.
+func Parse(header string) []*Cookie {
+	var cookies []*Cookie
+	for _, pair := range strings.Split(header, ";") {
+		pair = strings.TrimSpace(pair)
+		name, val, ok := strings.Cut(pair, "=")
+		if !ok || !isToken(name) {
+			continue
+		}
+		val, ok = parseValue(val)
+		if !ok {
+			continue
+		}
+		cookies = append(cookies, &Cookie{Name: name, Value: val})
+	}
+	return cookies
+}
+
+// Checks that the cookie can be serialised without producing a broken or injected header.
+func (c *Cookie) Valid() error {
+	if !isToken(c.Name) {
+		return fmt.Errorf("invalid cookie name %q", c.Name)
+	}
+	for i := 0; i < len(c.Value); i++ {
+		if !isValueByte(c.Value[i]) {
+			return fmt.Errorf("invalid byte %q in value of cookie %q", c.Value[i], c.Name)
+		}
+	}
+	if !isAttributeValue(c.Path) {
+		return fmt.Errorf("invalid path %q for cookie %q", c.Path, c.Name)
+	}
+	if !isAttributeValue(c.Domain) || strings.ContainsAny(c.Domain, " ,") {
+		return fmt.Errorf("invalid domain %q for cookie %q", c.Domain, c.Name)
+	}
+	if c.Partitioned && !c.Secure {
+		return errors.New("partitioned cookies must be secure")
+	}
+	if c.SameSite == SameSiteNone && !c.Secure {
+		return errors.New("SameSite=None cookies must be secure")
+	}
+	return nil
+}
+
+// Serialises the cookie as the value of a Set-Cookie header. Call Valid first; String
+// doesn't check its input.
+func (c *Cookie) String() string {
+	var b strings.Builder
+	b.WriteString(c.Name)
+	b.WriteString("=")
+	// Spaces and commas are allowed in values we send, but only inside quotes
+	if strings.ContainsAny(c.Value, " ,") {
+		b.WriteString(`"` + c.Value + `"`)
+	} else {
+		b.WriteString(c.Value)
+	}
+
+	if c.Path != "" {
+		b.WriteString("; Path=" + c.Path)
+	}
+	if c.Domain != "" {
+		b.WriteString("; Domain=" + strings.TrimPrefix(c.Domain, "."))
+	}
+	if !c.Expires.IsZero() {
+		b.WriteString("; Expires=" + c.Expires.UTC().Format(timeFormat))
+	}
+	if c.MaxAge > 0 {
+		b.WriteString("; Max-Age=" + strconv.Itoa(c.MaxAge))
+	} else if c.MaxAge < 0 {
+		b.WriteString("; Max-Age=0")
+	}
+	if c.Secure {
+		b.WriteString("; Secure")
+	}
+	if c.HttpOnly {
+		b.WriteString("; HttpOnly")
+	}
+	switch c.SameSite {
+	case SameSiteLax:
+		b.WriteString("; SameSite=Lax")
+	case SameSiteStrict:
+		b.WriteString("; SameSite=Strict")
+	case SameSiteNone:
+		b.WriteString("; SameSite=None")
+	}
+	if c.Partitioned {
+		b.WriteString("; Partitioned")
+	}
+	return b.String()
+}
+
+// Strips optional surrounding quotes and checks the remaining bytes.
+func parseValue(val string) (string, bool) {
+	if len(val) >= 2 && val[0] == '"' && val[len(val)-1] == '"' {
+		val = val[1 : len(val)-1]
+	}
+	for i := 0; i < len(val); i++ {
+		if !isValueByte(val[i]) {
+			return "", false
+		}
+	}
+	return val, true
+}
+
+// cookie-octet from RFC 6265, plus space and comma which String quotes.
+func isValueByte(b byte) bool {
+	return b >= 0x20 && b < 0x7f && b != '"' && b != ';' && b != '\\'
+}
+
+func isAttributeValue(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < 0x20 || s[i] == 0x7f || s[i] == ';' {
+			return false
+		}
+	}
+	return true
+}
+
+func isToken(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		b := s[i]
+		if b <= ' ' || b >= 0x7f || strings.IndexByte(`()<>@,;:\"/[]?={}`, b) != -1 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,61 @@
+package cookie
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParse(t *testing.T) {
+	// Test: Standard Cookie header
+	cookies := Parse("session=abc123; theme=dark; quoted=\"a b\"")
+	require.Len(t, cookies, 3)
+	assert.Equal(t, "session", cookies[0].Name)
+	assert.Equal(t, "abc123", cookies[0].Value)
+	assert.Equal(t, "theme", cookies[1].Name)
+	assert.Equal(t, "dark", cookies[1].Value)
+	assert.Equal(t, "a b", cookies[2].Value)
+
+	// Test: Invalid pairs are skipped
+	cookies = Parse("good=1; no-equals; bad name=2; =3; also=\"ok\"; bs=a\\b")
+	require.Len(t, cookies, 2)
+	assert.Equal(t, "good", cookies[0].Name)
+	assert.Equal(t, "also", cookies[1].Name)
+
+	// Test: Empty header
+	assert.Empty(t, Parse(""))
+}
+
+func TestString(t *testing.T) {
+	// Test: Every attribute
+	c := &Cookie{
+		Name:        "session",
+		Value:       "abc123",
+		Path:        "/",
+		Domain:      ".example.com",
+		Expires:     time.Date(2025, time.March, 4, 5, 6, 7, 0, time.FixedZone("CET", 3600)),
+		MaxAge:      3600,
+		Secure:      true,
+		HttpOnly:    true,
+		SameSite:    SameSiteNone,
+		Partitioned: true,
+	}
+	require.NoError(t, c.Valid())
+	assert.Equal(t, "session=abc123; Path=/; Domain=example.com; Expires=Tue, 04 Mar 2025 04:06:07 GMT; "+
+		"Max-Age=3600; Secure; HttpOnly; SameSite=None; Partitioned", c.String())
+
+	// Test: Deleting a cookie, values with commas are quoted
+	c = &Cookie{Name: "list", Value: "a,b", MaxAge: -1, SameSite: SameSiteLax}
+	require.NoError(t, c.Valid())
+	assert.Equal(t, "list=\"a,b\"; Max-Age=0; SameSite=Lax", c.String())
+
+	// Test: Invalid cookies
+	assert.Error(t, (&Cookie{Name: "bad name", Value: "x"}).Valid())
+	assert.Error(t, (&Cookie{Name: "x", Value: "a;b"}).Valid())
+	assert.Error(t, (&Cookie{Name: "x", Value: "a\r\nSet-Cookie: evil=1"}).Valid())
+	assert.Error(t, (&Cookie{Name: "x", Path: "/; Domain=evil.com"}).Valid())
+	assert.Error(t, (&Cookie{Name: "x", SameSite: SameSiteNone}).Valid())
+	assert.Error(t, (&Cookie{Name: "x", Partitioned: true}).Valid())
+}
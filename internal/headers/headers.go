@@ -3,18 +3,27 @@ package headers
 import (
 	"bytes"
 	"errors"
-	"fmt"
 	"strings"
 	"unicode"
 )
 
-type Headers map[string]string
+// Header fields in the order they were added. Names keep the casing they were given
+// but all lookups are case-insensitive, and a name may appear any number of times.
+// The zero value is ready to use; reads on a nil *Headers behave like an empty set.
+type Headers struct {
+	fields []field
+}
+
+type field struct {
+	name  string
+	value string
+}
 
-func NewHeaders() Headers {
-	return make(Headers)
+func NewHeaders() *Headers {
+	return &Headers{}
 }
 
-func (h Headers) Parse(data []byte) (n int, done bool, err error) {
+func (h *Headers) Parse(data []byte) (n int, done bool, err error) {
 
 	// Look for a CRLF, if it doesn't find one, assume you haven't been given enough data yet.
 	// Consume no data, return false for done, and nil for err.
@@ -31,6 +40,12 @@ func (h Headers) Parse(data []byte) (n int, done bool, err error) {
 	// Include the \r\n in our byte count
 	bytesConsumed := idxHeaderBytes + 2
 
+	// A line starting with whitespace continues the previous one (obs-fold, RFC 9112 5.2).
+	// Trimming it would turn " Transfer-Encoding: chunked" into a field of its own, so refuse it.
+	if data[0] == ' ' || data[0] == '\t' {
+		return 0, false, errors.New("obsolete line folding")
+	}
+
 	headerString := strings.TrimSpace(string(data[:idxHeaderBytes]))
 
 	colonIndex := strings.Index(headerString, ":")
@@ -48,24 +63,150 @@ func (h Headers) Parse(data []byte) (n int, done bool, err error) {
 		return 0, false, errors.New("field name contains illegal char")
 	}
 
-	headerKeyLower := strings.ToLower(headerKey)
-
-	// fmt.Printf("headerkey: %v, headerval: %v\n", headerKeyLower, headerValue)
-	h.Set(headerKeyLower, headerValue)
+	// fmt.Printf("headerkey: %v, headerval: %v\n", headerKey, headerValue)
+	h.Add(headerKey, headerValue)
 
 	return bytesConsumed, false, nil
 }
 
-func (h Headers) Set(key, val string) {
-	if _, exists := h[key]; exists {
-		h[key] += fmt.Sprintf(", %s", val)
-	} else {
-		h[key] = val
+// Appends a value for key, keeping any existing ones.
+func (h *Headers) Add(key, val string) {
+	h.fields = append(h.fields, field{name: key, value: val})
+}
+
+// Replaces all values for key with val. The field keeps the position of its first
+// occurrence, or goes to the end if it wasn't there yet.
+func (h *Headers) Set(key, val string) {
+	for i, f := range h.fields {
+		if strings.EqualFold(f.name, key) {
+			h.fields[i] = field{name: key, value: val}
+			h.del(key, i+1)
+			return
+		}
+	}
+	h.Add(key, val)
+}
+
+// Removes every value for key.
+func (h *Headers) Del(key string) {
+	h.del(key, 0)
+}
+
+// Removes every value for key at or after index from.
+func (h *Headers) del(key string, from int) {
+	kept := h.fields[:from]
+	for _, f := range h.fields[from:] {
+		if !strings.EqualFold(f.name, key) {
+			kept = append(kept, f)
+		}
+	}
+	clear(h.fields[len(kept):])
+	h.fields = kept
+}
+
+// Returns the first value for key, or "" if there is none.
+func (h *Headers) Get(key string) string {
+	if h == nil {
+		return ""
+	}
+	for _, f := range h.fields {
+		if strings.EqualFold(f.name, key) {
+			return f.value
+		}
+	}
+	return ""
+}
+
+// Returns every value for key in the order they were added.
+func (h *Headers) Values(key string) []string {
+	if h == nil {
+		return nil
+	}
+	var vals []string
+	for _, f := range h.fields {
+		if strings.EqualFold(f.name, key) {
+			vals = append(vals, f.value)
+		}
+	}
+	return vals
+}
+
+// Calls fn for every field in insertion order, with the name as it was given,
+// until fn returns false.
+func (h *Headers) Range(fn func(name, value string) bool) {
+	if h == nil {
+		return
+	}
+	for _, f := range h.fields {
+		if !fn(f.name, f.value) {
+			return
+		}
+	}
+}
+
+// Number of field lines, counting repeated names separately.
+func (h *Headers) Len() int {
+	if h == nil {
+		return 0
+	}
+	return len(h.fields)
+}
+
+func (h *Headers) Clone() *Headers {
+	if h == nil {
+		return nil
+	}
+	return &Headers{fields: append([]field(nil), h.fields...)}
+}
+
+// Reports whether any comma-separated value for key contains token, ignoring case.
+// Used for list-valued fields like Connection and Transfer-Encoding.
+func (h *Headers) HasToken(key, token string) bool {
+	for _, val := range h.Values(key) {
+		for _, elem := range strings.Split(val, ",") {
+			if strings.EqualFold(strings.TrimSpace(elem), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Returns the canonical form of a field name: the first letter and every letter after a
+// hyphen uppercased, the rest lowercased ("content-type" becomes "Content-Type").
+// Names that aren't valid field names are returned unchanged.
+func CanonicalKey(key string) string {
+	if !ValidName(key) {
+		return key
+	}
+	b := []byte(key)
+	upper := true
+	for i, ch := range b {
+		if upper && 'a' <= ch && ch <= 'z' {
+			b[i] = ch - ('a' - 'A')
+		} else if !upper && 'A' <= ch && ch <= 'Z' {
+			b[i] = ch + ('a' - 'A')
+		}
+		upper = ch == '-'
 	}
+	return string(b)
 }
 
-func (h Headers) Remove(key string) {
-	delete(h, key)
+// Reports whether name can be written as a field name: a non-empty token.
+func ValidName(name string) bool {
+	return name != "" && validateHeaderKey(name)
+}
+
+// Reports whether value can be written as a field value without ending the line early
+// or smuggling in another field. Control characters other than tab are refused.
+func ValidValue(value string) bool {
+	for i := 0; i < len(value); i++ {
+		ch := value[i]
+		if (ch < ' ' && ch != '\t') || ch == 0x7f {
+			return false
+		}
+	}
+	return true
 }
 
 func validateHeaderKey(key string) bool {
@@ -81,11 +222,3 @@ func isValidHeaderChar(r rune) bool {
 	// fmt.Printf("curchar as rune: %v and as str: %s\n", r, string(r))
 	return (r < 128) && unicode.IsLetter(r) || unicode.IsDigit(r) || strings.ContainsRune("!#$%&'*+-.^_`|~", r)
 }
-
-func (h Headers) Get(key string) string {
-	val, exists := h[strings.ToLower(key)]
-	if !exists {
-		return ""
-	}
-	return val
-}
@@ -14,7 +14,7 @@ func TestParseHeaders(t *testing.T) {
 	n, done, err := headers.Parse(data)
 	require.NoError(t, err)
 	require.NotNil(t, headers)
-	assert.Equal(t, "localhost:42069", headers["host"])
+	assert.Equal(t, "localhost:42069", headers.Get("host"))
 	assert.Equal(t, 23, n)
 	assert.False(t, done)
 
@@ -34,15 +34,25 @@ func TestParseHeaders(t *testing.T) {
 	assert.Equal(t, 0, n)
 	assert.False(t, done)
 
-	// Test: Valid single header with extra whitespace
+	// Test: Valid single header with extra whitespace after the value
 	headers = NewHeaders()
-	data = []byte("    User-Agent: curl/7.81.0     \r\n\r\n")
+	data = []byte("User-Agent: curl/7.81.0     \r\n\r\n")
 	n, done, err = headers.Parse(data)
 	require.NoError(t, err)
-	assert.Equal(t, "curl/7.81.0", headers["user-agent"])
-	assert.Equal(t, 34, n)
+	assert.Equal(t, "curl/7.81.0", headers.Get("user-agent"))
+	assert.Equal(t, 30, n)
 	assert.False(t, done)
 
+	// Test: Leading whitespace is obsolete line folding
+	for _, line := range []string{"    User-Agent: curl/7.81.0\r\n\r\n", "\tTransfer-Encoding: chunked\r\n\r\n"} {
+		headers = NewHeaders()
+		n, done, err = headers.Parse([]byte(line))
+		require.Error(t, err)
+		assert.Equal(t, 0, n)
+		assert.False(t, done)
+		assert.Equal(t, 0, headers.Len())
+	}
+
 	// Test: Valid done
 	headers = NewHeaders()
 	data = []byte("\r\n")
@@ -56,7 +66,7 @@ func TestParseHeaders(t *testing.T) {
 	data = []byte("Invalid:HeaderFormat\r\n")
 	n, done, err = headers.Parse(data)
 	require.NoError(t, err)
-	assert.Equal(t, "HeaderFormat", headers["invalid"])
+	assert.Equal(t, "HeaderFormat", headers.Get("invalid"))
 	assert.Equal(t, 22, n) // 22 is the length of the string "Invalid:HeaderFormat" + "\r\n"
 	assert.False(t, done)
 
@@ -69,23 +79,23 @@ func TestParseHeaders(t *testing.T) {
 	assert.False(t, done)
 
 	// Test: Valid multiple values for
-	headers = Headers{
-		"user-agent": "testing123",
-	}
+	headers = NewHeaders()
+	headers.Set("user-agent", "testing123")
 	data = []byte("User-Agent: curl/7.81.0\r\n\r\n")
 	n, done, err = headers.Parse(data)
 	require.NoError(t, err)
-	assert.Equal(t, "testing123, curl/7.81.0", headers["user-agent"])
+	assert.Equal(t, []string{"testing123", "curl/7.81.0"}, headers.Values("user-agent"))
 	assert.False(t, done)
 
 	// Test: Valid 2 headers with existing headers
-	headers = map[string]string{"host": "localhost:42069"}
+	headers = NewHeaders()
+	headers.Set("host", "localhost:42069")
 	data = []byte("User-Agent: curl/7.81.0\r\nAccept: */*\r\n\r\n")
 	n, done, err = headers.Parse(data)
 	require.NoError(t, err)
 	require.NotNil(t, headers)
-	assert.Equal(t, "localhost:42069", headers["host"])
-	assert.Equal(t, "curl/7.81.0", headers["user-agent"])
+	assert.Equal(t, "localhost:42069", headers.Get("host"))
+	assert.Equal(t, "curl/7.81.0", headers.Get("user-agent"))
 	assert.Equal(t, 25, n)
 	assert.False(t, done)
 
@@ -104,3 +114,74 @@ func TestValidateHeaderKey(t *testing.T) {
 	res = validateHeaderKey(str)
 	assert.True(t, res)
 }
+
+func TestHeadersMultiValue(t *testing.T) {
+	headers := NewHeaders()
+	data := []byte("Host: localhost\r\nSet-Cookie: a=1\r\nX-Trace: one\r\nset-cookie: b=2, c=3\r\n\r\n")
+	for {
+		n, done, err := headers.Parse(data)
+		require.NoError(t, err)
+		data = data[n:]
+		if done {
+			break
+		}
+	}
+
+	// Test: Case-insensitive lookups over repeated fields
+	assert.Equal(t, 4, headers.Len())
+	assert.Equal(t, "a=1", headers.Get("SET-COOKIE"))
+	assert.Equal(t, []string{"a=1", "b=2, c=3"}, headers.Values("Set-Cookie"))
+	assert.Nil(t, headers.Values("missing"))
+
+	// Test: Range keeps insertion order and original casing
+	var names []string
+	headers.Range(func(name, value string) bool {
+		names = append(names, name)
+		return true
+	})
+	assert.Equal(t, []string{"Host", "Set-Cookie", "X-Trace", "set-cookie"}, names)
+
+	// Test: Set replaces every value in place of the first one
+	headers.Set("Set-Cookie", "z=9")
+	names = nil
+	headers.Range(func(name, value string) bool {
+		names = append(names, name+": "+value)
+		return true
+	})
+	assert.Equal(t, []string{"Host: localhost", "Set-Cookie: z=9", "X-Trace: one"}, names)
+
+	// Test: Add appends, Del removes all
+	headers.Add("x-trace", "two")
+	assert.Equal(t, []string{"one", "two"}, headers.Values("X-Trace"))
+	assert.True(t, headers.HasToken("x-trace", "TWO"))
+	headers.Del("X-TRACE")
+	assert.Equal(t, "", headers.Get("X-Trace"))
+	assert.Equal(t, 2, headers.Len())
+
+	// Test: Clone is independent
+	clone := headers.Clone()
+	clone.Set("Host", "example.com")
+	assert.Equal(t, "localhost", headers.Get("Host"))
+
+	// Test: Reads on nil Headers
+	var nilHeaders *Headers
+	assert.Equal(t, "", nilHeaders.Get("Host"))
+	assert.Equal(t, 0, nilHeaders.Len())
+	assert.False(t, nilHeaders.HasToken("Connection", "close"))
+}
+
+func TestCanonicalKey(t *testing.T) {
+	assert.Equal(t, "Content-Type", CanonicalKey("content-type"))
+	assert.Equal(t, "Content-Type", CanonicalKey("CONTENT-TYPE"))
+	assert.Equal(t, "X-Content-Sha256", CanonicalKey("x-content-SHA256"))
+	assert.Equal(t, "Www-Authenticate", CanonicalKey("WWW-Authenticate"))
+	assert.Equal(t, "bad key", CanonicalKey("bad key"))
+
+	assert.True(t, ValidName("X-Custom_Header.1"))
+	assert.False(t, ValidName(""))
+	assert.False(t, ValidName("Bad\r\nName"))
+
+	assert.True(t, ValidValue("text/html; charset=utf-8\twith tab"))
+	assert.False(t, ValidValue("value\r\nSet-Cookie: evil=1"))
+	assert.False(t, ValidValue("nul\x00"))
+}
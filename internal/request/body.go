@@ -0,0 +1,270 @@
+package request
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/boxy-pug/httpfromtcp/internal/headers"
+)
+
+// Reads a request body straight off the connection, decoding chunked framing on the fly.
+// Returned by Parser.Next as Request.BodyReader when Parser.StreamBody is set.
+type bodyReader struct {
+	parser *Parser
+	req    *Request
+	closed bool
+	eof    bool // The end was reached through Read
+}
+
+func (b *bodyReader) Read(p []byte) (int, error) {
+	if b.closed {
+		return 0, errors.New("read on closed body")
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	for b.req.state != stateDone {
+		data := b.parser.buf[:b.parser.readToIndex]
+		bytesConsumed, body, err := b.req.parseBody(data, len(p))
+		if err != nil {
+			return 0, asParseError(err)
+		}
+		// Copy out before consume shifts the buffer underneath body
+		n := copy(p, body)
+		b.parser.consume(bytesConsumed)
+
+		if n > 0 {
+			return n, nil
+		}
+		if bytesConsumed > 0 {
+			// Only framing (chunk size, CRLF, trailers) was consumed, keep going
+			continue
+		}
+
+		if err := b.parser.fill(b.req); err != nil {
+			return 0, err
+		}
+	}
+	if !b.eof {
+		b.eof = true
+		b.req.bodyDone()
+	}
+	return 0, io.EOF
+}
+
+// Stops further reads. Whatever is left of the body is skipped by the Parser before
+// it reads the next request, so the connection stays usable.
+func (b *bodyReader) Close() error {
+	b.closed = true
+	return nil
+}
+
+// Skips the rest of a body the handler didn't read.
+func (b *bodyReader) discard() error {
+	for b.req.state != stateDone {
+		data := b.parser.buf[:b.parser.readToIndex]
+		bytesConsumed, _, err := b.req.parseBody(data, len(data))
+		if err != nil {
+			return asParseError(err)
+		}
+		b.parser.consume(bytesConsumed)
+		if bytesConsumed > 0 {
+			continue
+		}
+		if err := b.parser.fill(b.req); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Reports whether the state machine is somewhere inside the message body.
+func (r *Request) inBody() bool {
+	return r.state >= stateParsingBody && r.state < stateDone
+}
+
+// Advances the body state machine by one step. Returns the number of bytes consumed from
+// data and the slice of it (at most max bytes) that is body content, with chunk framing stripped.
+func (r *Request) parseBody(data []byte, max int) (int, []byte, error) {
+	switch r.state {
+	case stateParsingBody:
+		// Take the data up to Content-Length. Anything past that
+		// belongs to the next request on the connection.
+		toRead := min(len(data), r.contentRemaining, max)
+		r.contentRemaining -= toRead
+
+		if r.contentRemaining == 0 {
+			r.state = stateDone
+		}
+
+		return toRead, data[:toRead], nil
+
+	case stateParsingChunkSize:
+		size, bytesConsumed, err := parseChunkSize(data)
+		if err != nil || bytesConsumed == 0 {
+			return 0, nil, err
+		}
+
+		// Compared before adding, a huge size must not wrap the running total around
+		if size > r.limits.MaxBodyBytes-r.bodyBytes {
+			return 0, nil, &ParseError{Err: ErrBodyTooLarge, Reason: fmt.Sprintf("more than %d bytes", r.limits.MaxBodyBytes)}
+		}
+		r.bodyBytes += size
+
+		// A zero-sized chunk is the last-chunk, only the trailer section follows
+		if size == 0 {
+			r.fieldBytes, r.fieldCount = 0, 0
+			r.state = stateParsingTrailers
+		} else {
+			r.chunkRemaining = int(size)
+			r.state = stateParsingChunkData
+		}
+		return bytesConsumed, nil, nil
+
+	case stateParsingChunkData:
+		toRead := min(len(data), r.chunkRemaining, max)
+		r.chunkRemaining -= toRead
+
+		if r.chunkRemaining == 0 {
+			r.state = stateParsingChunkDataEnd
+		}
+		return toRead, data[:toRead], nil
+
+	case stateParsingChunkDataEnd:
+		// Every chunk's data is followed by a CRLF
+		if len(data) < 2 {
+			return 0, nil, nil
+		}
+		if !bytes.HasPrefix(data, []byte("\r\n")) {
+			return 0, nil, errors.New("missing CRLF after chunk data")
+		}
+		r.state = stateParsingChunkSize
+		return 2, nil, nil
+
+	case stateParsingTrailers:
+		if r.Trailers == nil {
+			r.Trailers = headers.NewHeaders()
+		}
+
+		// The trailer section has the same syntax as the header section
+		bytesConsumed, done, err := r.Trailers.Parse(data)
+		if err != nil {
+			return 0, nil, err
+		}
+		if err := r.checkFieldLimits(bytesConsumed, data, done); err != nil {
+			return 0, nil, err
+		}
+		if done {
+			r.state = stateDone
+		}
+		return bytesConsumed, nil, nil
+
+	default:
+		return 0, nil, errors.New("error: not parsing a body")
+	}
+}
+
+// Works out how the body is framed once the headers are complete and moves to the matching state.
+func (r *Request) beginBody() error {
+	transferEncoding := strings.Join(r.Headers.Values("transfer-encoding"), ", ")
+	contentLength := r.Headers.Get("content-length")
+	// Repeating Content-Length is allowed only if every copy agrees
+	for _, val := range r.Headers.Values("content-length") {
+		if val != contentLength {
+			return errors.New("conflicting content-length values")
+		}
+	}
+
+	if transferEncoding != "" {
+		// A message with both is a request smuggling vector, refuse it outright
+		if contentLength != "" {
+			return errors.New("both transfer-encoding and content-length present")
+		}
+		if !strings.EqualFold(strings.TrimSpace(transferEncoding), "chunked") {
+			return &ParseError{Err: ErrUnsupportedTransferCoding, Reason: transferEncoding}
+		}
+		r.state = stateParsingChunkSize
+		return nil
+	}
+
+	//If there isn't a Content-Length header, move to the done state, nothing to parse
+	if contentLength == "" {
+		r.state = stateDone
+		return nil
+	}
+
+	// Content-Length is 1*DIGIT, Atoi alone would also take a sign
+	intContentLength, err := strconv.Atoi(contentLength)
+	if err != nil || !isDigits(contentLength) {
+		return errors.New("could not parse content length as int")
+	}
+	if int64(intContentLength) > r.limits.MaxBodyBytes {
+		return &ParseError{Err: ErrBodyTooLarge, Reason: fmt.Sprintf("content-length %d exceeds %d bytes", intContentLength, r.limits.MaxBodyBytes)}
+	}
+	r.contentRemaining = intContentLength
+
+	if intContentLength == 0 {
+		r.state = stateDone
+	} else {
+		r.state = stateParsingBody
+	}
+	return nil
+}
+
+// Reports whether s is a non-empty run of ASCII digits.
+func isDigits(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// Longest chunk-size line (size plus extensions) we are willing to buffer.
+const maxChunkSizeLineBytes = 4096
+
+// Parses a chunk-size line: the size in hex, optionally followed by chunk extensions
+// (";name=value"), which we validate but otherwise ignore.
+// Returns 0 bytes consumed if the line isn't complete yet.
+func parseChunkSize(data []byte) (int64, int, error) {
+	idx := bytes.Index(data, []byte("\r\n"))
+	if idx == -1 {
+		if len(data) > maxChunkSizeLineBytes {
+			return 0, 0, errors.New("chunk size line too long")
+		}
+		return 0, 0, nil
+	}
+
+	line := string(data[:idx])
+	sizeString, extensions, _ := strings.Cut(line, ";")
+	sizeString = strings.TrimRight(sizeString, " \t")
+
+	if sizeString == "" {
+		return 0, 0, errors.New("missing chunk size")
+	}
+	// ParseInt would also accept a leading sign, which isn't valid chunk-size syntax
+	size, err := strconv.ParseInt(sizeString, 16, 64)
+	if err != nil || strings.IndexAny(sizeString, "+-") != -1 {
+		return 0, 0, fmt.Errorf("invalid chunk size: %q", sizeString)
+	}
+
+	if extensions != "" {
+		for _, ext := range strings.Split(extensions, ";") {
+			name, _, _ := strings.Cut(ext, "=")
+			if strings.TrimSpace(name) == "" {
+				return 0, 0, errors.New("empty chunk extension name")
+			}
+		}
+	}
+
+	return size, idx + 2, nil
+}
@@ -0,0 +1,32 @@
+package request
+
+import (
+	"net"
+	"net/netip"
+	"time"
+)
+
+// Where and when a request arrived, filled in by the server.
+type ConnInfo struct {
+	RemoteAddr net.Addr
+	LocalAddr  net.Addr
+	// Identifies the connection, counting up from 1 in the order the server accepts them
+	ID uint64
+	// Position of the request on its connection, 1 for the first
+	Seq int
+
+	// When the first byte of the request arrived. For a pipelined request that was read
+	// together with the one before, when the server got to it.
+	FirstByte time.Time
+	// When the header section was complete
+	HeadersDone time.Time
+}
+
+// Returns the client's IP address for TCP connections, IPv4-mapped addresses as plain
+// IPv4. Not valid for other connections, e.g. on Unix sockets.
+func (c *ConnInfo) RemoteIP() netip.Addr {
+	if addr, ok := c.RemoteAddr.(*net.TCPAddr); ok {
+		return addr.AddrPort().Addr().Unmap()
+	}
+	return netip.Addr{}
+}
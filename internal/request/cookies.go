@@ -0,0 +1,28 @@
+package request
+
+import (
+	"errors"
+
+	"github.com/boxy-pug/httpfromtcp/internal/cookie"
+)
+
+var ErrNoCookie = errors.New("named cookie not present")
+
+// Returns the cookies sent in the Cookie header, in order.
+func (r *Request) Cookies() []*cookie.Cookie {
+	var cookies []*cookie.Cookie
+	for _, val := range r.Headers.Values("cookie") {
+		cookies = append(cookies, cookie.Parse(val)...)
+	}
+	return cookies
+}
+
+// Returns the first cookie called name.
+func (r *Request) Cookie(name string) (*cookie.Cookie, error) {
+	for _, c := range r.Cookies() {
+		if c.Name == name {
+			return c, nil
+		}
+	}
+	return nil, ErrNoCookie
+}
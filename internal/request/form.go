@@ -0,0 +1,144 @@
+package request
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"strings"
+)
+
+var (
+	ErrNotMultipart    = errors.New("request Content-Type isn't multipart/form-data")
+	ErrMissingFile     = errors.New("no such file in multipart form")
+	ErrMultipartLimits = errors.New("multipart form exceeds limits")
+)
+
+// Default memory budget for ParseMultipartForm when it is called implicitly by FormValue or FormFile.
+const DefaultMaxFormMemory = 32 << 20
+
+// Fills in Form and PostForm. Query parameters always end up in Form; for POST, PUT and
+// PATCH requests with an application/x-www-form-urlencoded body, the decoded body fields
+// are added to both, ahead of the query parameters in Form. Reads the body through BodyReader.
+// Calling it again is a no-op.
+func (r *Request) ParseForm() error {
+	if r.formParsed {
+		return nil
+	}
+	r.formParsed = true
+
+	if r.hasFormBody() {
+		mediaType, _, err := r.contentType()
+		if err != nil {
+			return err
+		}
+		if mediaType == "application/x-www-form-urlencoded" {
+			body, err := io.ReadAll(r.BodyReader)
+			if err != nil {
+				return err
+			}
+			if r.PostForm, err = ParseQuery(string(body)); err != nil {
+				return err
+			}
+		}
+	}
+
+	r.buildForm()
+	return nil
+}
+
+// Fills Form from scratch: the body fields in PostForm followed by the query parameters.
+func (r *Request) buildForm() {
+	r.Form = Query{}
+	for _, key := range r.PostForm.Keys() {
+		for _, val := range r.PostForm.Values(key) {
+			r.Form.Add(key, val)
+		}
+	}
+	if r.URL != nil {
+		for _, key := range r.URL.Query.Keys() {
+			for _, val := range r.URL.Query.Values(key) {
+				r.Form.Add(key, val)
+			}
+		}
+	}
+}
+
+// Parses a multipart/form-data body into MultipartForm, also calling ParseForm. Non-file
+// fields and file parts are kept in memory up to a combined maxMemory bytes; file parts
+// beyond that are written to temporary files, which the server removes once the handler
+// returns. Non-file fields that don't fit in maxMemory fail the parse.
+func (r *Request) ParseMultipartForm(maxMemory int64) error {
+	if r.MultipartForm != nil {
+		return nil
+	}
+	if err := r.ParseForm(); err != nil {
+		return err
+	}
+
+	mediaType, params, err := r.contentType()
+	if err != nil {
+		return err
+	}
+	if mediaType != "multipart/form-data" || !r.hasFormBody() {
+		return ErrNotMultipart
+	}
+
+	form, err := readMultipartForm(r.BodyReader, params["boundary"], maxMemory, r.limits)
+	if err != nil {
+		return err
+	}
+	r.MultipartForm = form
+
+	for _, key := range form.Value.Keys() {
+		for _, val := range form.Value.Values(key) {
+			r.PostForm.Add(key, val)
+		}
+	}
+	// ParseForm already put the query parameters in Form, the body fields go first
+	r.buildForm()
+	return nil
+}
+
+// Returns the first value for key from the body or query, parsing the form if needed.
+// Parse errors are ignored; call ParseForm or ParseMultipartForm to see them.
+func (r *Request) FormValue(key string) string {
+	if r.MultipartForm == nil {
+		r.ParseMultipartForm(DefaultMaxFormMemory)
+	}
+	return r.Form.Get(key)
+}
+
+// Returns the first file uploaded under key, parsing the multipart form if needed.
+func (r *Request) FormFile(key string) (*FileHeader, error) {
+	if r.MultipartForm == nil {
+		if err := r.ParseMultipartForm(DefaultMaxFormMemory); err != nil {
+			return nil, err
+		}
+	}
+	if files := r.MultipartForm.File[key]; len(files) > 0 {
+		return files[0], nil
+	}
+	return nil, ErrMissingFile
+}
+
+// Only these methods carry form fields in the body.
+func (r *Request) hasFormBody() bool {
+	switch r.RequestLine.Method {
+	case "POST", "PUT", "PATCH":
+		return r.BodyReader != nil
+	}
+	return false
+}
+
+func (r *Request) contentType() (string, map[string]string, error) {
+	ct := r.Headers.Get("content-type")
+	if ct == "" {
+		return "", nil, nil
+	}
+	mediaType, params, err := mime.ParseMediaType(ct)
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid content-type %q: %w", ct, err)
+	}
+	return strings.ToLower(mediaType), params, nil
+}
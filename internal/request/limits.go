@@ -0,0 +1,75 @@
+package request
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Bounds on how much of a request the parser is willing to hold. A zero field means
+// the value from DefaultLimits.
+type Limits struct {
+	MaxRequestLineBytes int   // Length of the request line, including the CRLF
+	MaxHeaderBytes      int   // Total size of the header section, and separately of the trailer section
+	MaxHeaderCount      int   // Number of header (or trailer) field lines
+	MaxBodyBytes        int64 // Decoded body size, buffered or streamed
+}
+
+var DefaultLimits = Limits{
+	MaxRequestLineBytes: 8 << 10,
+	MaxHeaderBytes:      1 << 20,
+	MaxHeaderCount:      100,
+	MaxBodyBytes:        10 << 20,
+}
+
+func (l Limits) withDefaults() Limits {
+	if l.MaxRequestLineBytes <= 0 {
+		l.MaxRequestLineBytes = DefaultLimits.MaxRequestLineBytes
+	}
+	if l.MaxHeaderBytes <= 0 {
+		l.MaxHeaderBytes = DefaultLimits.MaxHeaderBytes
+	}
+	if l.MaxHeaderCount <= 0 {
+		l.MaxHeaderCount = DefaultLimits.MaxHeaderCount
+	}
+	if l.MaxBodyBytes <= 0 {
+		l.MaxBodyBytes = DefaultLimits.MaxBodyBytes
+	}
+	return l
+}
+
+// Sentinel errors wrapped by every ParseError, so callers can pick a response status with errors.Is.
+var (
+	ErrMalformedRequest          = errors.New("malformed request")             // 400
+	ErrRequestLineTooLong        = errors.New("request line too long")         // 414
+	ErrHeaderTooLarge            = errors.New("header section too large")      // 431
+	ErrBodyTooLarge              = errors.New("body too large")                // 413
+	ErrUnsupportedVersion        = errors.New("unsupported HTTP version")      // 505
+	ErrUnsupportedTransferCoding = errors.New("unsupported transfer-encoding") // 501
+)
+
+// Returned when the bytes on the wire aren't an acceptable request. I/O errors from the
+// underlying reader are returned as-is instead, since there is nobody left to answer.
+type ParseError struct {
+	Err    error // One of the sentinel errors above
+	Reason string
+}
+
+func (e *ParseError) Error() string {
+	if e.Reason == "" {
+		return e.Err.Error()
+	}
+	return fmt.Sprintf("%s: %s", e.Err, e.Reason)
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// Leaves ParseErrors alone and turns anything else from the state machine into a malformed request.
+func asParseError(err error) error {
+	var parseErr *ParseError
+	if err == nil || errors.As(err, &parseErr) {
+		return err
+	}
+	return &ParseError{Err: ErrMalformedRequest, Reason: err.Error()}
+}
@@ -0,0 +1,323 @@
+package request
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"os"
+	"path/filepath"
+
+	"github.com/boxy-pug/httpfromtcp/internal/headers"
+)
+
+// Most parts a single multipart form may contain.
+const maxMultipartParts = 1000
+
+type MultipartForm struct {
+	Value Query
+	File  map[string][]*FileHeader
+}
+
+// Describes one uploaded file part. Its content is either in memory or in a temporary file.
+type FileHeader struct {
+	Filename string // Base name from Content-Disposition, any directory part stripped
+	Headers  *headers.Headers
+	Size     int64
+
+	content []byte
+	tmpfile string
+}
+
+// Opens the uploaded content for reading.
+func (f *FileHeader) Open() (io.ReadSeekCloser, error) {
+	if f.tmpfile != "" {
+		return os.Open(f.tmpfile)
+	}
+	return nopCloser{bytes.NewReader(f.content)}, nil
+}
+
+type nopCloser struct {
+	io.ReadSeeker
+}
+
+func (nopCloser) Close() error { return nil }
+
+// Deletes any temporary files backing the form's file parts.
+func (f *MultipartForm) RemoveAll() error {
+	var errs []error
+	for _, files := range f.File {
+		for _, fh := range files {
+			if fh.tmpfile == "" {
+				continue
+			}
+			if err := os.Remove(fh.tmpfile); err != nil && !errors.Is(err, os.ErrNotExist) {
+				errs = append(errs, err)
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func readMultipartForm(body io.Reader, boundary string, maxMemory int64, limits Limits) (_ *MultipartForm, err error) {
+	if boundary == "" || len(boundary) > 70 {
+		return nil, fmt.Errorf("invalid multipart boundary %q", boundary)
+	}
+
+	form := &MultipartForm{File: make(map[string][]*FileHeader)}
+	defer func() {
+		if err != nil {
+			form.RemoveAll()
+		}
+	}()
+
+	mr := newMultipartReader(body, boundary, limits)
+	remaining := maxMemory
+
+	for parts := 0; ; parts++ {
+		h, err := mr.nextPart()
+		if err == io.EOF {
+			return form, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if parts == maxMultipartParts {
+			return nil, fmt.Errorf("%w: more than %d parts", ErrMultipartLimits, maxMultipartParts)
+		}
+
+		name, filename := formDataNames(h)
+		if name == "" {
+			// Not a form field, skip it
+			if err := mr.copyPart(io.Discard); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		if filename == "" {
+			var buf bytes.Buffer
+			if err := mr.copyPart(&memoryWriter{buf: &buf, remaining: &remaining}); err != nil {
+				return nil, err
+			}
+			form.Value.Add(name, buf.String())
+			continue
+		}
+
+		fh := &FileHeader{Filename: filename, Headers: h}
+		form.File[name] = append(form.File[name], fh)
+
+		sw := &spillWriter{remaining: remaining}
+		err = mr.copyPart(sw)
+		if sw.file != nil {
+			fh.tmpfile = sw.file.Name()
+			if closeErr := sw.file.Close(); err == nil {
+				err = closeErr
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+		fh.Size = sw.size
+		if sw.file == nil {
+			fh.content = sw.mem.Bytes()
+			remaining -= sw.size
+		}
+	}
+}
+
+// Pulls the name and filename parameters out of a part's Content-Disposition.
+func formDataNames(h *headers.Headers) (string, string) {
+	disposition, params, err := mime.ParseMediaType(h.Get("content-disposition"))
+	if err != nil || disposition != "form-data" {
+		return "", ""
+	}
+	filename := params["filename"]
+	if filename != "" {
+		filename = filepath.Base(filepath.Clean("/" + filename))
+	}
+	return params["name"], filename
+}
+
+// Collects a non-file field, failing once the form's memory budget runs out.
+type memoryWriter struct {
+	buf       *bytes.Buffer
+	remaining *int64
+}
+
+func (w *memoryWriter) Write(p []byte) (int, error) {
+	if int64(len(p)) > *w.remaining {
+		return 0, fmt.Errorf("%w: form fields larger than memory budget", ErrMultipartLimits)
+	}
+	*w.remaining -= int64(len(p))
+	return w.buf.Write(p)
+}
+
+// Keeps a file part in memory until it outgrows remaining, then moves it to a temporary file.
+type spillWriter struct {
+	remaining int64
+	mem       bytes.Buffer
+	file      *os.File
+	size      int64
+}
+
+func (w *spillWriter) Write(p []byte) (int, error) {
+	w.size += int64(len(p))
+	if w.file == nil && w.size <= w.remaining {
+		return w.mem.Write(p)
+	}
+	if w.file == nil {
+		f, err := os.CreateTemp("", "multipart-")
+		if err != nil {
+			return 0, err
+		}
+		w.file = f
+		if _, err := f.Write(w.mem.Bytes()); err != nil {
+			return 0, err
+		}
+		w.mem = bytes.Buffer{}
+	}
+	return w.file.Write(p)
+}
+
+// Splits a multipart body into parts. Works on a growing buffer like Parser, so it never
+// needs more than one line or one delimiter's worth of lookahead.
+type multipartReader struct {
+	reader    io.Reader
+	buf       []byte
+	n         int    // Bytes of buf in use
+	delimiter []byte // CRLF "--" boundary
+	limits    Limits
+	inPart    bool // Content of a part (or the preamble) is still unread
+	done      bool
+}
+
+func newMultipartReader(reader io.Reader, boundary string, limits Limits) *multipartReader {
+	m := &multipartReader{
+		reader:    reader,
+		buf:       make([]byte, 4096),
+		delimiter: []byte("\r\n--" + boundary),
+		limits:    limits.withDefaults(),
+		inPart:    true,
+	}
+	// Pretend the body starts with a CRLF so the first boundary looks like all the others
+	m.n = copy(m.buf, "\r\n")
+	return m
+}
+
+// Skips to the next part and parses its headers. Returns io.EOF after the closing delimiter.
+func (m *multipartReader) nextPart() (*headers.Headers, error) {
+	if m.done {
+		return nil, io.EOF
+	}
+
+	// Skip the preamble, or whatever the caller left unread of the previous part
+	if m.inPart {
+		if err := m.copyPart(io.Discard); err != nil {
+			return nil, err
+		}
+	}
+
+	// The delimiter is followed by "--" on the last one, else optional padding and a CRLF
+	for {
+		if m.n >= 2 && bytes.HasPrefix(m.buf[:m.n], []byte("--")) {
+			m.done = true
+			return nil, io.EOF
+		}
+		if idx := bytes.Index(m.buf[:m.n], []byte("\r\n")); idx != -1 {
+			if len(bytes.Trim(m.buf[:idx], " \t")) != 0 {
+				return nil, errors.New("garbage after multipart boundary")
+			}
+			m.consume(idx + 2)
+			break
+		}
+		if m.n > 1024 {
+			return nil, errors.New("garbage after multipart boundary")
+		}
+		if err := m.fill(); err != nil {
+			return nil, err
+		}
+	}
+
+	h := headers.NewHeaders()
+	headerBytes, headerCount := 0, 0
+	for {
+		bytesConsumed, done, err := h.Parse(m.buf[:m.n])
+		if err != nil {
+			return nil, fmt.Errorf("invalid part header: %w", err)
+		}
+		m.consume(bytesConsumed)
+		headerBytes += bytesConsumed
+		if done {
+			m.inPart = true
+			return h, nil
+		}
+		if bytesConsumed > 0 {
+			headerCount++
+		}
+		if headerCount > m.limits.MaxHeaderCount || headerBytes > m.limits.MaxHeaderBytes ||
+			(bytesConsumed == 0 && headerBytes+m.n > m.limits.MaxHeaderBytes) {
+			return nil, fmt.Errorf("%w: part headers too large", ErrMultipartLimits)
+		}
+		if bytesConsumed == 0 {
+			if err := m.fill(); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+// Copies the current part's content to w and consumes the delimiter that ends it.
+func (m *multipartReader) copyPart(w io.Writer) error {
+	for {
+		if idx := bytes.Index(m.buf[:m.n], m.delimiter); idx != -1 {
+			if _, err := w.Write(m.buf[:idx]); err != nil {
+				return err
+			}
+			m.consume(idx + len(m.delimiter))
+			m.inPart = false
+			return nil
+		}
+
+		// Everything except a possible partial delimiter at the end is content
+		if safe := m.n - (len(m.delimiter) - 1); safe > 0 {
+			if _, err := w.Write(m.buf[:safe]); err != nil {
+				return err
+			}
+			m.consume(safe)
+		}
+
+		if err := m.fill(); err != nil {
+			return err
+		}
+	}
+}
+
+func (m *multipartReader) consume(n int) {
+	copy(m.buf, m.buf[n:m.n])
+	m.n -= n
+}
+
+// Reads more of the body. Running out of body is always an error here since callers
+// only ask for more when the current part or delimiter isn't complete.
+func (m *multipartReader) fill() error {
+	if m.n == len(m.buf) {
+		newBuf := make([]byte, len(m.buf)*2)
+		copy(newBuf, m.buf)
+		m.buf = newBuf
+	}
+	for {
+		n, err := m.reader.Read(m.buf[m.n:])
+		m.n += n
+		if n > 0 {
+			return nil
+		}
+		if err == io.EOF {
+			return fmt.Errorf("multipart body: %w", io.ErrUnexpectedEOF)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -2,10 +2,10 @@ package request
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
-	"strconv"
 	"strings"
 
 	"github.com/boxy-pug/httpfromtcp/internal/headers"
@@ -14,8 +14,39 @@ import (
 type Request struct {
 	RequestLine RequestLine
 	state       int
-	Headers     headers.Headers
+	Headers     *headers.Headers
 	Body        []byte
+	// Parsed RequestLine.RequestTarget
+	URL *URL
+	// Trailer fields sent after the last chunk of a chunked body. Nil for other requests.
+	Trailers *headers.Headers
+	// Address of the client the request came from, filled in by the server
+	RemoteAddr string
+	// Set by the server for requests that came in over TLS
+	TLS *TLSInfo
+	// Connection details and arrival times, set by the server
+	Conn *ConnInfo
+
+	// Streams the body. With Parser.StreamBody unset it simply reads from Body.
+	BodyReader io.ReadCloser
+
+	// Filled in by ParseForm and ParseMultipartForm
+	Form          Query // Body fields followed by query parameters
+	PostForm      Query // Body fields only
+	MultipartForm *MultipartForm
+	formParsed    bool
+
+	ctx              context.Context
+	pathValues       map[string]string
+	limits           Limits
+	streamBody       bool // Stop parsing once the headers are done and leave the body to BodyReader
+	onHeaders        func(req *Request)
+	onBodyDone       func(req *Request)
+	fieldBytes       int   // Size of the header (or trailer) section so far
+	fieldCount       int   // Number of header (or trailer) lines so far
+	bodyBytes        int64 // Decoded size of a chunked body so far
+	contentRemaining int   // Body bytes left to read, if the body isn't chunked
+	chunkRemaining   int   // Bytes left in the chunk currently being read
 }
 
 type RequestLine struct {
@@ -28,62 +59,180 @@ const (
 	stateInitialized = iota
 	requestStateParsingHeaders
 	stateParsingBody
+	stateParsingChunkSize
+	stateParsingChunkData
+	stateParsingChunkDataEnd
+	stateParsingTrailers
 	stateDone
 )
 
 const bufferSize = 8 // Start with a small buffer to test chunking
 
+// Reads successive requests from a single connection. Bytes read past the end of one
+// request are kept in the buffer and become the start of the next, so pipelined
+// requests (sent back-to-back before any response) are not lost.
+type Parser struct {
+	// If set, Next returns as soon as the headers are parsed and the body has to be
+	// read through Request.BodyReader instead of being buffered into Request.Body.
+	StreamBody bool
+	// Size limits applied to every request. Zero fields fall back to DefaultLimits.
+	Limits Limits
+	// Called by Next once the header section of a request is parsed, before its body is read.
+	OnHeaders func(req *Request)
+	// Called once the whole request, body included, has been read for the handler: by Next,
+	// or for a streamed body by Request.BodyReader when it reaches the end. Not called for
+	// a body Next skips because the handler left it unread.
+	OnBodyDone func(req *Request)
+
+	reader      io.Reader
+	buf         []byte
+	readToIndex int         // Track how much data we've read into our buffer
+	body        *bodyReader // Body of the last streamed request, may not be fully read yet
+}
+
+func NewParser(reader io.Reader) *Parser {
+	return &Parser{
+		reader: reader,
+		buf:    make([]byte, bufferSize),
+	}
+}
+
+// Parses a single request from reader. Anything the reader delivers after the end of
+// that request is discarded; use a Parser to read several requests from one stream.
 func RequestFromReader(reader io.Reader) (*Request, error) {
-	// Create a buffer to read data into
-	buf := make([]byte, bufferSize)
+	return NewParser(reader).Next()
+}
+
+// Returns the next request on the stream. Returns io.EOF if the stream ends cleanly
+// before the first byte of a new request.
+func (p *Parser) Next() (*Request, error) {
+	// Skip whatever the handler left unread of the previous streamed body
+	if p.body != nil {
+		if err := p.body.discard(); err != nil {
+			// Not a ParseError on purpose: the previous request has already been answered
+			return nil, fmt.Errorf("skipping unread body: %v", err)
+		}
+		p.body = nil
+	}
 
 	// Create a new Request with initialized state
 	req := &Request{
-		state: stateInitialized,
+		state:      stateInitialized,
+		streamBody: p.StreamBody,
+		limits:     p.Limits.withDefaults(),
+		onHeaders:  p.OnHeaders,
+		onBodyDone: p.OnBodyDone,
 	}
 
-	readToIndex := 0 // Track how much data we've read into our buffer
-
 	// Continue reading and parsing until we're done
-	for req.state != stateDone {
-		// If buffer is full, grow it
-		if readToIndex == len(buf) {
-			newBuf := make([]byte, len(buf)*2)
-			copy(newBuf, buf)
-			buf = newBuf
-		}
-
-		// Read the next chunk of data
-		n, err := reader.Read(buf[readToIndex:])
+	for {
+		// Try to parse the data we have so far, which may be left over from the previous request
+		bytesConsumed, err := req.parse(p.buf[:p.readToIndex])
 		if err != nil {
-			if err == io.EOF {
-				// If we've reached EOF without completing the request, it's an error
-				if req.state != stateDone {
-					return nil, errors.New("incomplete request: reached EOF")
-				}
-				break
-			}
-			return nil, fmt.Errorf("error reading from reader: %v", err)
+			return nil, err
 		}
+		p.consume(bytesConsumed)
 
-		// Update how much data we've read
-		readToIndex += n
+		if req.state == stateDone {
+			req.BodyReader = io.NopCloser(bytes.NewReader(req.Body))
+			req.bodyDone()
+			return req, nil
+		}
+		if req.streamBody && req.inBody() {
+			p.body = &bodyReader{parser: p, req: req}
+			req.BodyReader = p.body
+			return req, nil
+		}
 
-		// Try to parse the data we have so far
-		bytesConsumed, err := req.parse(buf[:readToIndex])
-		if err != nil {
+		if err := p.fill(req); err != nil {
 			return nil, err
 		}
+	}
+}
 
-		// If we consumed bytes, we need to shift the buffer
-		if bytesConsumed > 0 {
-			// Move the remaining bytes to the beginning of the buffer
-			copy(buf, buf[bytesConsumed:readToIndex])
-			readToIndex -= bytesConsumed
-		}
+// Returns the number of bytes read from the stream but not parsed yet, e.g. the start
+// of a pipelined request.
+func (p *Parser) Buffered() int {
+	return p.readToIndex
+}
+
+// Returns the request's context, context.Background() if none was set. The server cancels
+// it when the client goes away, the server is closed or the handler returns.
+func (r *Request) Context() context.Context {
+	if r.ctx == nil {
+		return context.Background()
+	}
+	return r.ctx
+}
+
+// Replaces the request's context, e.g. with one derived from Context that carries values
+// for handlers further down. Panics if ctx is nil.
+func (r *Request) SetContext(ctx context.Context) {
+	if ctx == nil {
+		panic("request: nil context")
+	}
+	r.ctx = ctx
+}
+
+// Returns the value of the path parameter called name set by a router, or "" if there
+// is none.
+func (r *Request) PathValue(name string) string {
+	return r.pathValues[name]
+}
+
+// Sets the path parameter called name, as returned by PathValue.
+func (r *Request) SetPathValue(name, value string) {
+	if r.pathValues == nil {
+		r.pathValues = make(map[string]string)
+	}
+	r.pathValues[name] = value
+}
+
+// Reports whether the whole request, body included, has been read off the stream.
+func (r *Request) BodyComplete() bool {
+	return r.state == stateDone
+}
+
+func (r *Request) bodyDone() {
+	if r.onBodyDone != nil {
+		r.onBodyDone(r)
+	}
+}
+
+// Moves the unparsed remainder of the buffer to the front.
+func (p *Parser) consume(n int) {
+	if n > 0 {
+		copy(p.buf, p.buf[n:p.readToIndex])
+		p.readToIndex -= n
+	}
+}
+
+// Reads the next chunk of data into the buffer, growing it if it is full.
+func (p *Parser) fill(req *Request) error {
+	if p.readToIndex == len(p.buf) {
+		newBuf := make([]byte, len(p.buf)*2)
+		copy(newBuf, p.buf)
+		p.buf = newBuf
 	}
 
-	return req, nil
+	n, err := p.reader.Read(p.buf[p.readToIndex:])
+	p.readToIndex += n
+	if n > 0 {
+		// Parse what we got first, the error will come back on the next read
+		return nil
+	}
+	if err != nil {
+		if err == io.EOF {
+			// EOF before a single byte means the peer closed cleanly between requests
+			if req.state == stateInitialized && p.readToIndex == 0 {
+				return io.EOF
+			}
+			// If we've reached EOF without completing the request, it's an error
+			return fmt.Errorf("incomplete request: %w", io.ErrUnexpectedEOF)
+		}
+		return fmt.Errorf("error reading from reader: %w", err)
+	}
+	return nil
 }
 
 func parseRequestLine(b []byte) (*RequestLine, int, error) {
@@ -113,7 +262,7 @@ func parseRequestLine(b []byte) (*RequestLine, int, error) {
 
 	requestLine, err := parseRequestLineElems(requestList)
 	if err != nil {
-		return nil, 0, errors.New("could not parse req line elements")
+		return nil, 0, err
 	}
 
 	return requestLine, bytesConsumed, nil
@@ -121,7 +270,10 @@ func parseRequestLine(b []byte) (*RequestLine, int, error) {
 
 func parseRequestLineElems(rl []string) (*RequestLine, error) {
 	httpVer := rl[2]
-	httpVerNum := strings.Split(httpVer, "/")[1]
+	httpVerNum, ok := strings.CutPrefix(httpVer, "HTTP/")
+	if !ok || !isVersionNumber(httpVerNum) {
+		return nil, fmt.Errorf("invalid http version: %q", httpVer)
+	}
 	reqTarget := rl[1]
 	method := rl[0]
 
@@ -136,7 +288,7 @@ func parseRequestLineElems(rl []string) (*RequestLine, error) {
 
 	// Checking that http version is "HTTP/1.1"
 	if httpVer != "HTTP/1.1" {
-		return nil, errors.New("wrong http version")
+		return nil, &ParseError{Err: ErrUnsupportedVersion, Reason: httpVer}
 	}
 
 	return &RequestLine{
@@ -147,13 +299,18 @@ func parseRequestLineElems(rl []string) (*RequestLine, error) {
 
 }
 
+// Checks for the DIGIT "." DIGIT form of an HTTP version number.
+func isVersionNumber(v string) bool {
+	return len(v) == 3 && v[0] >= '0' && v[0] <= '9' && v[1] == '.' && v[2] >= '0' && v[2] <= '9'
+}
+
 // The parse method processes a chunk of data
 func (r *Request) parse(data []byte) (int, error) {
 	totalBytesParsed := 0
-	for r.state != stateDone {
+	for r.state != stateDone && !(r.streamBody && r.inBody()) {
 		n, err := r.parseSingle(data[totalBytesParsed:])
 		if err != nil {
-			return totalBytesParsed, err
+			return totalBytesParsed, asParseError(err)
 		}
 		if n == 0 {
 			// no more data and no error means were done
@@ -168,6 +325,12 @@ func (r *Request) parse(data []byte) (int, error) {
 func (r *Request) parseSingle(data []byte) (int, error) {
 	switch r.state {
 	case stateInitialized:
+		// Don't keep buffering a request line that can no longer fit
+		lineEnd := bytes.Index(data, []byte("\r\n"))
+		if (lineEnd == -1 && len(data) >= r.limits.MaxRequestLineBytes) || lineEnd+2 > r.limits.MaxRequestLineBytes {
+			return 0, &ParseError{Err: ErrRequestLineTooLong}
+		}
+
 		// Try to parse the request line from the current chunk
 		requestLine, bytesConsumed, err := parseRequestLine(data)
 
@@ -180,8 +343,14 @@ func (r *Request) parseSingle(data []byte) (int, error) {
 			return 0, nil
 		}
 
+		target, err := ParseTarget(requestLine.Method, requestLine.RequestTarget)
+		if err != nil {
+			return 0, err
+		}
+
 		// Successfully parsed the request line
 		r.RequestLine = *requestLine
+		r.URL = target
 		r.state = requestStateParsingHeaders
 		return bytesConsumed, nil
 
@@ -198,46 +367,29 @@ func (r *Request) parseSingle(data []byte) (int, error) {
 		if err != nil {
 			return 0, err
 		}
+		if err := r.checkFieldLimits(bytesConsumed, data, done); err != nil {
+			return 0, err
+		}
 
 		// If we're done parsing headers, move to the next state
 		if done {
-			r.state = stateParsingBody
-		}
-
-		return bytesConsumed, nil
-
-	case stateParsingBody:
-		//If there isn't a Content-Length header, move to the done state, nothing to parse
-		contentLength := r.Headers.Get("content-length")
-		var intContentLength int
-		var err error
-		if contentLength == "" {
-			r.state = stateDone
-			return 0, nil
-		} else {
-			intContentLength, err = strconv.Atoi(contentLength)
-			if err != nil {
-				return 0, errors.New("could not parse content length as int")
+			if err := r.beginBody(); err != nil {
+				return 0, err
+			}
+			if r.onHeaders != nil {
+				r.onHeaders(r)
 			}
 		}
 
-		// Append all the data to the requests .Body field.
-		r.Body = append(r.Body, data...)
+		return bytesConsumed, nil
 
-		// If the length of the body is greater than the Content-Length header, return an error.
-		if len(r.Body) > intContentLength {
-			return 0, errors.New("body longer than content-length")
-		} else if len(r.Body) == intContentLength {
-			r.state = stateDone
+	case stateParsingBody, stateParsingChunkSize, stateParsingChunkData, stateParsingChunkDataEnd, stateParsingTrailers:
+		bytesConsumed, body, err := r.parseBody(data, len(data))
+		if err != nil {
+			return 0, err
 		}
-
-		return len(data), nil
-
-		/*Add a case for the new state in the state machine:
-
-		  If the length of the body is equal to the Content-Length header, move to the done state.
-		  Report that you've consumed the entire length of the data you were given
-		*/
+		r.Body = append(r.Body, body...)
+		return bytesConsumed, nil
 
 	case stateDone:
 		return 0, errors.New("error: trying to read data in a done state")
@@ -246,3 +398,21 @@ func (r *Request) parseSingle(data []byte) (int, error) {
 		return 0, errors.New("error: unknown state")
 	}
 }
+
+// Enforces MaxHeaderBytes and MaxHeaderCount after each call to Headers.Parse. Used for
+// both the header and the trailer section.
+func (r *Request) checkFieldLimits(bytesConsumed int, data []byte, done bool) error {
+	r.fieldBytes += bytesConsumed
+	if bytesConsumed > 0 && !done {
+		r.fieldCount++
+	}
+
+	if r.fieldCount > r.limits.MaxHeaderCount {
+		return &ParseError{Err: ErrHeaderTooLarge, Reason: fmt.Sprintf("more than %d fields", r.limits.MaxHeaderCount)}
+	}
+	// Nothing consumed means data holds an incomplete line; don't wait for one that can't fit
+	if r.fieldBytes > r.limits.MaxHeaderBytes || (bytesConsumed == 0 && r.fieldBytes+len(data) > r.limits.MaxHeaderBytes) {
+		return &ParseError{Err: ErrHeaderTooLarge, Reason: fmt.Sprintf("more than %d bytes", r.limits.MaxHeaderBytes)}
+	}
+	return nil
+}
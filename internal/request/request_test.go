@@ -1,7 +1,13 @@
 package request
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"io"
+	"net/url"
+	"os"
+	"strconv"
 	"strings"
 	"testing"
 
@@ -140,9 +146,9 @@ func TestRequestFromReader(t *testing.T) {
 	r, err := RequestFromReader(reader)
 	require.NoError(t, err)
 	require.NotNil(t, r)
-	assert.Equal(t, "localhost:42069", r.Headers["host"])
-	assert.Equal(t, "curl/7.81.0", r.Headers["user-agent"])
-	assert.Equal(t, "*/*", r.Headers["accept"])
+	assert.Equal(t, "localhost:42069", r.Headers.Get("host"))
+	assert.Equal(t, "curl/7.81.0", r.Headers.Get("user-agent"))
+	assert.Equal(t, "*/*", r.Headers.Get("accept"))
 
 	// Test: Nonsense not valid
 	reader = &chunkReader{
@@ -162,8 +168,8 @@ func TestEmptyHeaders(t *testing.T) {
 	r, err := RequestFromReader(reader)
 	require.NoError(t, err)
 	require.NotNil(t, r)
-	assert.Equal(t, "", r.Headers["host"])
-	assert.Equal(t, "", r.Headers["user-agent"])
+	assert.Equal(t, "", r.Headers.Get("host"))
+	assert.Equal(t, "", r.Headers.Get("user-agent"))
 }
 
 func TestDuplicateHeaders(t *testing.T) {
@@ -172,8 +178,9 @@ func TestDuplicateHeaders(t *testing.T) {
 	r, err := RequestFromReader(reader)
 	require.NoError(t, err)
 	require.NotNil(t, r)
-	// Assuming the parser keeps the last value for duplicate headers
-	assert.Equal(t, "localhost, example.com", r.Headers["host"])
+	// Repeated fields keep every value in order, Get returns the first
+	assert.Equal(t, []string{"localhost", "example.com"}, r.Headers.Values("host"))
+	assert.Equal(t, "localhost", r.Headers.Get("host"))
 }
 
 func TestCaseInsensitiveHeaders(t *testing.T) {
@@ -182,9 +189,9 @@ func TestCaseInsensitiveHeaders(t *testing.T) {
 	r, err := RequestFromReader(reader)
 	require.NoError(t, err)
 	require.NotNil(t, r)
-	assert.Equal(t, "localhost", r.Headers["host"])
-	assert.Equal(t, "curl", r.Headers["user-agent"])
-	assert.Equal(t, "*/*", r.Headers["accept"])
+	assert.Equal(t, "localhost", r.Headers.Get("host"))
+	assert.Equal(t, "curl", r.Headers.Get("user-agent"))
+	assert.Equal(t, "*/*", r.Headers.Get("accept"))
 }
 
 func TestMissingEndOfHeaders(t *testing.T) {
@@ -271,3 +278,722 @@ func TestBodyParser(t *testing.T) {
 	assert.Equal(t, "", string(r.Body))
 
 }
+
+func TestPipelinedRequests(t *testing.T) {
+	// Test: Two requests sent back-to-back, the first with a body
+	reader := &chunkReader{
+		data: "POST /submit HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Content-Length: 5\r\n" +
+			"\r\n" +
+			"hello" +
+			"GET /next HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"\r\n",
+		numBytesPerRead: 7,
+	}
+	p := NewParser(reader)
+
+	r, err := p.Next()
+	require.NoError(t, err)
+	require.NotNil(t, r)
+	assert.Equal(t, "/submit", r.RequestLine.RequestTarget)
+	assert.Equal(t, "hello", string(r.Body))
+
+	r, err = p.Next()
+	require.NoError(t, err)
+	require.NotNil(t, r)
+	assert.Equal(t, "GET", r.RequestLine.Method)
+	assert.Equal(t, "/next", r.RequestLine.RequestTarget)
+	assert.Equal(t, "", string(r.Body))
+
+	// Test: Clean EOF between requests
+	_, err = p.Next()
+	assert.ErrorIs(t, err, io.EOF)
+
+	// Test: Whole pipeline delivered in a single read
+	p = NewParser(strings.NewReader("GET /a HTTP/1.1\r\nHost: x\r\n\r\nGET /b HTTP/1.1\r\nHost: x\r\n\r\n"))
+	r, err = p.Next()
+	require.NoError(t, err)
+	assert.Equal(t, "/a", r.RequestLine.RequestTarget)
+	r, err = p.Next()
+	require.NoError(t, err)
+	assert.Equal(t, "/b", r.RequestLine.RequestTarget)
+
+	// Test: Truncated second request is an error, not a clean EOF
+	p = NewParser(strings.NewReader("GET /a HTTP/1.1\r\nHost: x\r\n\r\nGET /b HT"))
+	_, err = p.Next()
+	require.NoError(t, err)
+	_, err = p.Next()
+	require.Error(t, err)
+	assert.NotErrorIs(t, err, io.EOF)
+}
+
+func TestChunkedBody(t *testing.T) {
+	// Test: Standard chunked body, read one byte at a time
+	reader := &chunkReader{
+		data: "POST /upload HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"\r\n" +
+			"5\r\nhello\r\n" +
+			"7\r\n world!\r\n" +
+			"0\r\n" +
+			"\r\n",
+		numBytesPerRead: 1,
+	}
+	r, err := RequestFromReader(reader)
+	require.NoError(t, err)
+	require.NotNil(t, r)
+	assert.Equal(t, "hello world!", string(r.Body))
+	assert.Empty(t, r.Trailers)
+
+	// Test: Uppercase hex size, chunk extensions and trailers
+	reader = &chunkReader{
+		data: "POST /upload HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"Trailer: X-Checksum\r\n" +
+			"\r\n" +
+			"A;name=value;flag\r\n0123456789\r\n" +
+			"1 ; foo=\"bar\"\r\n!\r\n" +
+			"0;last\r\n" +
+			"X-Checksum: abc123\r\n" +
+			"\r\n",
+		numBytesPerRead: 3,
+	}
+	r, err = RequestFromReader(reader)
+	require.NoError(t, err)
+	require.NotNil(t, r)
+	assert.Equal(t, "0123456789!", string(r.Body))
+	assert.Equal(t, "abc123", r.Trailers.Get("X-Checksum"))
+
+	// Test: Invalid chunk size
+	reader = &chunkReader{
+		data: "POST /upload HTTP/1.1\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"\r\n" +
+			"zz\r\nhello\r\n0\r\n\r\n",
+		numBytesPerRead: 2,
+	}
+	_, err = RequestFromReader(reader)
+	require.Error(t, err)
+
+	// Test: Signed chunk size
+	reader = &chunkReader{
+		data: "POST /upload HTTP/1.1\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"\r\n" +
+			"+5\r\nhello\r\n0\r\n\r\n",
+		numBytesPerRead: 2,
+	}
+	_, err = RequestFromReader(reader)
+	require.Error(t, err)
+
+	// Test: Transfer-Encoding folded onto the previous line is refused, not decoded
+	reader = &chunkReader{
+		data: "POST /upload HTTP/1.1\r\n" +
+			"X-Padding: x\r\n" +
+			" Transfer-Encoding: chunked\r\n" +
+			"\r\n" +
+			"5\r\nhello\r\n0\r\n\r\n",
+		numBytesPerRead: 2,
+	}
+	_, err = RequestFromReader(reader)
+	assert.ErrorIs(t, err, ErrMalformedRequest)
+
+	// Test: Chunk data longer than its size
+	reader = &chunkReader{
+		data: "POST /upload HTTP/1.1\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"\r\n" +
+			"3\r\nhello\r\n0\r\n\r\n",
+		numBytesPerRead: 2,
+	}
+	_, err = RequestFromReader(reader)
+	require.Error(t, err)
+
+	// Test: Missing last-chunk
+	reader = &chunkReader{
+		data: "POST /upload HTTP/1.1\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"\r\n" +
+			"5\r\nhello\r\n",
+		numBytesPerRead: 2,
+	}
+	_, err = RequestFromReader(reader)
+	require.Error(t, err)
+
+	// Test: Both Transfer-Encoding and Content-Length
+	reader = &chunkReader{
+		data: "POST /upload HTTP/1.1\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"Content-Length: 5\r\n" +
+			"\r\n" +
+			"5\r\nhello\r\n0\r\n\r\n",
+		numBytesPerRead: 4,
+	}
+	_, err = RequestFromReader(reader)
+	require.Error(t, err)
+
+	// Test: Unsupported transfer coding
+	reader = &chunkReader{
+		data: "POST /upload HTTP/1.1\r\n" +
+			"Transfer-Encoding: gzip\r\n" +
+			"\r\n",
+		numBytesPerRead: 4,
+	}
+	_, err = RequestFromReader(reader)
+	require.Error(t, err)
+
+	// Test: Chunked request followed by a pipelined request
+	reader = &chunkReader{
+		data: "POST /upload HTTP/1.1\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"\r\n" +
+			"5\r\nhello\r\n0\r\n\r\n" +
+			"GET /next HTTP/1.1\r\n" +
+			"\r\n",
+		numBytesPerRead: 5,
+	}
+	p := NewParser(reader)
+	r, err = p.Next()
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(r.Body))
+	r, err = p.Next()
+	require.NoError(t, err)
+	assert.Equal(t, "/next", r.RequestLine.RequestTarget)
+}
+
+func TestStreamingBody(t *testing.T) {
+	// Test: Content-Length body is left on the wire until the handler reads it
+	reader := &chunkReader{
+		data: "POST /submit HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Content-Length: 13\r\n" +
+			"\r\n" +
+			"hello world!\n",
+		numBytesPerRead: 3,
+	}
+	p := NewParser(reader)
+	p.StreamBody = true
+	r, err := p.Next()
+	require.NoError(t, err)
+	require.NotNil(t, r)
+	assert.Nil(t, r.Body)
+	body, err := io.ReadAll(r.BodyReader)
+	require.NoError(t, err)
+	assert.Equal(t, "hello world!\n", string(body))
+
+	// Test: Chunked body is decoded while streaming, trailers are available afterwards
+	reader = &chunkReader{
+		data: "POST /upload HTTP/1.1\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"\r\n" +
+			"5\r\nhello\r\n" +
+			"7\r\n world!\r\n" +
+			"0\r\n" +
+			"X-Checksum: abc123\r\n" +
+			"\r\n",
+		numBytesPerRead: 2,
+	}
+	p = NewParser(reader)
+	p.StreamBody = true
+	r, err = p.Next()
+	require.NoError(t, err)
+	body, err = io.ReadAll(r.BodyReader)
+	require.NoError(t, err)
+	assert.Equal(t, "hello world!", string(body))
+	assert.Equal(t, "abc123", r.Trailers.Get("X-Checksum"))
+
+	// Test: Unread body is skipped before the next pipelined request
+	reader = &chunkReader{
+		data: "POST /upload HTTP/1.1\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"\r\n" +
+			"5\r\nhello\r\n0\r\n\r\n" +
+			"POST /submit HTTP/1.1\r\n" +
+			"Content-Length: 3\r\n" +
+			"\r\n" +
+			"abc" +
+			"GET /last HTTP/1.1\r\n" +
+			"\r\n",
+		numBytesPerRead: 4,
+	}
+	p = NewParser(reader)
+	p.StreamBody = true
+	r, err = p.Next()
+	require.NoError(t, err)
+	require.NoError(t, r.BodyReader.Close())
+	_, err = r.BodyReader.Read(make([]byte, 1))
+	require.Error(t, err)
+	r, err = p.Next()
+	require.NoError(t, err)
+	assert.Equal(t, "/submit", r.RequestLine.RequestTarget)
+	buf := make([]byte, 1)
+	n, err := r.BodyReader.Read(buf)
+	require.NoError(t, err)
+	assert.Equal(t, "a", string(buf[:n]))
+	r, err = p.Next()
+	require.NoError(t, err)
+	assert.Equal(t, "/last", r.RequestLine.RequestTarget)
+
+	// Test: Truncated body
+	p = NewParser(strings.NewReader("POST /submit HTTP/1.1\r\nContent-Length: 20\r\n\r\npartial content"))
+	p.StreamBody = true
+	r, err = p.Next()
+	require.NoError(t, err)
+	_, err = io.ReadAll(r.BodyReader)
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+
+	// Test: Buffered requests can be read through BodyReader too
+	r, err = RequestFromReader(strings.NewReader("POST /submit HTTP/1.1\r\nContent-Length: 5\r\n\r\nhello"))
+	require.NoError(t, err)
+	body, err = io.ReadAll(r.BodyReader)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(body))
+}
+
+func TestParserLimits(t *testing.T) {
+	limits := Limits{
+		MaxRequestLineBytes: 32,
+		MaxHeaderBytes:      64,
+		MaxHeaderCount:      3,
+		MaxBodyBytes:        10,
+	}
+	parse := func(data string) error {
+		p := NewParser(&chunkReader{data: data, numBytesPerRead: 3})
+		p.Limits = limits
+		_, err := p.Next()
+		return err
+	}
+
+	// Test: Within all limits
+	err := parse("POST /submit HTTP/1.1\r\nHost: localhost\r\nContent-Length: 5\r\n\r\nhello")
+	require.NoError(t, err)
+
+	// Test: Request line too long, with and without a CRLF in sight
+	err = parse("GET /" + strings.Repeat("a", 40) + " HTTP/1.1\r\n\r\n")
+	assert.ErrorIs(t, err, ErrRequestLineTooLong)
+	err = parse("GET /" + strings.Repeat("a", 40))
+	assert.ErrorIs(t, err, ErrRequestLineTooLong)
+
+	// Test: Header section too large
+	err = parse("GET / HTTP/1.1\r\nX-Big: " + strings.Repeat("a", 80) + "\r\n\r\n")
+	assert.ErrorIs(t, err, ErrHeaderTooLarge)
+
+	// Test: Too many header lines
+	err = parse("GET / HTTP/1.1\r\nA: 1\r\nB: 2\r\nC: 3\r\nD: 4\r\n\r\n")
+	assert.ErrorIs(t, err, ErrHeaderTooLarge)
+
+	// Test: Content-Length above the body limit is refused before reading the body
+	err = parse("POST / HTTP/1.1\r\nContent-Length: 11\r\n\r\n")
+	assert.ErrorIs(t, err, ErrBodyTooLarge)
+
+	// Test: Chunked body growing past the limit
+	err = parse("POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n6\r\nhello \r\n6\r\nworld!\r\n0\r\n\r\n")
+	assert.ErrorIs(t, err, ErrBodyTooLarge)
+
+	// Test: A chunk size that would overflow the running total
+	err = parse("POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n1\r\na\r\n7fffffffffffffff\r\n" + strings.Repeat("x", 64))
+	assert.ErrorIs(t, err, ErrBodyTooLarge)
+
+	// Test: Too many trailer lines
+	err = parse("POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n0\r\nA: 1\r\nB: 2\r\nC: 3\r\nD: 4\r\n\r\n")
+	assert.ErrorIs(t, err, ErrHeaderTooLarge)
+
+	// Test: Unsupported version and transfer coding
+	err = parse("GET / HTTP/2.0\r\n\r\n")
+	assert.ErrorIs(t, err, ErrUnsupportedVersion)
+	err = parse("POST / HTTP/1.1\r\nTransfer-Encoding: gzip\r\n\r\n")
+	assert.ErrorIs(t, err, ErrUnsupportedTransferCoding)
+
+	// Test: Everything else is a malformed request
+	err = parse("GET / FTP/1.1\r\n\r\n")
+	assert.ErrorIs(t, err, ErrMalformedRequest)
+	err = parse("GET / HTTP/1.1\r\nHost localhost\r\n\r\n")
+	assert.ErrorIs(t, err, ErrMalformedRequest)
+	var parseErr *ParseError
+	assert.ErrorAs(t, err, &parseErr)
+
+	// Test: I/O errors are not parse errors
+	err = parse("GET / HTTP/1.1\r\nHost: localhost\r\n")
+	assert.NotErrorAs(t, err, &parseErr)
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+}
+
+func TestRequestTarget(t *testing.T) {
+	// Test: Origin-form with percent-encoding and repeated query keys
+	r, err := RequestFromReader(strings.NewReader("GET /caf%C3%A9/menu%2Fitems?b=2&a=1&b=3&q=hot+coffee&flag HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	require.NotNil(t, r.URL)
+	assert.Equal(t, OriginForm, r.URL.Form)
+	assert.Equal(t, "/café/menu/items", r.URL.Path)
+	assert.Equal(t, "/caf%C3%A9/menu%2Fitems", r.URL.RawPath)
+	assert.Equal(t, "b=2&a=1&b=3&q=hot+coffee&flag", r.URL.RawQuery)
+	assert.Equal(t, []string{"b", "a", "q", "flag"}, r.URL.Query.Keys())
+	assert.Equal(t, []string{"2", "3"}, r.URL.Query.Values("b"))
+	assert.Equal(t, "1", r.URL.Query.Get("a"))
+	assert.Equal(t, "hot coffee", r.URL.Query.Get("q"))
+	assert.True(t, r.URL.Query.Has("flag"))
+	assert.False(t, r.URL.Query.Has("missing"))
+
+	tests := []struct {
+		name     string
+		method   string
+		target   string
+		wantForm TargetForm
+		wantHost string
+		wantPath string
+		wantErr  bool
+	}{
+		{name: "Absolute-form", method: "GET", target: "http://example.com:8080/a%20b?x=1", wantForm: AbsoluteForm, wantHost: "example.com:8080", wantPath: "/a b"},
+		{name: "Absolute-form without path", method: "GET", target: "HTTPS://example.com", wantForm: AbsoluteForm, wantHost: "example.com", wantPath: "/"},
+		{name: "Absolute-form query without path", method: "GET", target: "http://example.com?x=1", wantForm: AbsoluteForm, wantHost: "example.com", wantPath: "/"},
+		{name: "Authority-form", method: "CONNECT", target: "example.com:443", wantForm: AuthorityForm, wantHost: "example.com:443"},
+		{name: "Authority-form IPv6", method: "CONNECT", target: "[::1]:443", wantForm: AuthorityForm, wantHost: "[::1]:443"},
+		{name: "Asterisk-form", method: "OPTIONS", target: "*", wantForm: AsteriskForm},
+		{name: "Asterisk-form on GET", method: "GET", target: "*", wantErr: true},
+		{name: "CONNECT without port", method: "CONNECT", target: "example.com", wantErr: true},
+		{name: "CONNECT with path", method: "CONNECT", target: "/index.html", wantErr: true},
+		{name: "Fragment", method: "GET", target: "/page#section", wantErr: true},
+		{name: "Bad percent-encoding", method: "GET", target: "/%zz", wantErr: true},
+		{name: "Unknown scheme", method: "GET", target: "ftp://example.com/", wantErr: true},
+		{name: "Relative path", method: "GET", target: "index.html", wantErr: true},
+		{name: "Userinfo", method: "GET", target: "http://user@example.com/", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u, err := ParseTarget(tt.method, tt.target)
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantForm, u.Form)
+			assert.Equal(t, tt.wantHost, u.Host)
+			assert.Equal(t, tt.wantPath, u.Path)
+		})
+	}
+
+	// Test: A bad target fails the whole request as malformed
+	_, err = RequestFromReader(strings.NewReader("GET /page#section HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	assert.ErrorIs(t, err, ErrMalformedRequest)
+}
+
+func TestParseForm(t *testing.T) {
+	// Test: URL-encoded body fields come before query parameters in Form
+	reader := &chunkReader{
+		data: "POST /submit?lang=en&name=query HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Content-Type: application/x-www-form-urlencoded; charset=utf-8\r\n" +
+			"Content-Length: 32\r\n" +
+			"\r\n" +
+			"name=Jo+Doe&tag=a&tag=b%26c&flag",
+		numBytesPerRead: 3,
+	}
+	r, err := RequestFromReader(reader)
+	require.NoError(t, err)
+	require.NoError(t, r.ParseForm())
+	assert.Equal(t, []string{"name", "tag", "flag"}, r.PostForm.Keys())
+	assert.Equal(t, []string{"a", "b&c"}, r.PostForm.Values("tag"))
+	assert.Equal(t, []string{"Jo Doe", "query"}, r.Form.Values("name"))
+	assert.Equal(t, "en", r.Form.Get("lang"))
+	assert.Equal(t, "", r.PostForm.Get("lang"))
+	assert.Equal(t, "Jo Doe", r.FormValue("name"))
+
+	// Test: GET only looks at the query
+	r, err = RequestFromReader(strings.NewReader("GET /search?q=go HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	require.NoError(t, r.ParseForm())
+	assert.Equal(t, "go", r.Form.Get("q"))
+	assert.Empty(t, r.PostForm.Keys())
+
+	// Test: Bad encoding in the body
+	r, err = RequestFromReader(strings.NewReader("POST / HTTP/1.1\r\nContent-Type: application/x-www-form-urlencoded\r\nContent-Length: 5\r\n\r\na=%zz"))
+	require.NoError(t, err)
+	require.Error(t, r.ParseForm())
+}
+
+func multipartRequest(body string) string {
+	return "POST /upload?source=test HTTP/1.1\r\n" +
+		"Host: localhost:42069\r\n" +
+		"Content-Type: multipart/form-data; boundary=xYzZY\r\n" +
+		"Content-Length: " + strconv.Itoa(len(body)) + "\r\n" +
+		"\r\n" +
+		body
+}
+
+func TestParseMultipartForm(t *testing.T) {
+	body := "preamble to ignore\r\n" +
+		"--xYzZY\r\n" +
+		"Content-Disposition: form-data; name=\"title\"\r\n" +
+		"\r\n" +
+		"My vacation\r\n" +
+		"--xYzZY  \r\n" +
+		"Content-Disposition: form-data; name=\"photo\"; filename=\"../../etc/beach.txt\"\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"sand\r\nand --xYzZ sea\r\n" +
+		"--xYzZY\r\n" +
+		"Content-Disposition: form-data; name=\"photo\"; filename=\"big.txt\"\r\n" +
+		"\r\n" +
+		strings.Repeat("0123456789", 10) + "\r\n" +
+		"--xYzZY\r\n" +
+		"Content-Disposition: form-data; name=\"title\"\r\n" +
+		"\r\n" +
+		"\r\n" +
+		"--xYzZY--\r\n" +
+		"epilogue"
+
+	// Test: Fields and files, read in tiny chunks, with a memory budget that forces a spill
+	r, err := RequestFromReader(&chunkReader{data: multipartRequest(body), numBytesPerRead: 3})
+	require.NoError(t, err)
+	require.NoError(t, r.ParseMultipartForm(64))
+	defer r.MultipartForm.RemoveAll()
+
+	assert.Equal(t, []string{"My vacation", ""}, r.MultipartForm.Value.Values("title"))
+	assert.Equal(t, []string{"My vacation", ""}, r.PostForm.Values("title"))
+	assert.Equal(t, "test", r.Form.Get("source"))
+
+	// Test: Body fields come before query parameters in Form, as for urlencoded bodies
+	withQuery, err := RequestFromReader(strings.NewReader(strings.Replace(multipartRequest(body), "?source=test", "?title=query&source=test", 1)))
+	require.NoError(t, err)
+	require.NoError(t, withQuery.ParseMultipartForm(1<<20))
+	defer withQuery.MultipartForm.RemoveAll()
+	assert.Equal(t, []string{"My vacation", "", "query"}, withQuery.Form.Values("title"))
+	assert.Equal(t, []string{"title", "source"}, withQuery.Form.Keys())
+	assert.Equal(t, []string{"My vacation", ""}, withQuery.PostForm.Values("title"))
+
+	files := r.MultipartForm.File["photo"]
+	require.Len(t, files, 2)
+	assert.Equal(t, "beach.txt", files[0].Filename)
+	assert.Equal(t, "text/plain", files[0].Headers.Get("Content-Type"))
+	assert.Equal(t, int64(20), files[0].Size)
+	assert.Empty(t, files[0].tmpfile)
+	assert.Equal(t, "big.txt", files[1].Filename)
+	assert.Equal(t, int64(100), files[1].Size)
+	assert.NotEmpty(t, files[1].tmpfile)
+
+	for _, fh := range files {
+		f, err := fh.Open()
+		require.NoError(t, err)
+		content, err := io.ReadAll(f)
+		f.Close()
+		require.NoError(t, err)
+		assert.Len(t, content, int(fh.Size))
+	}
+	fh, err := r.FormFile("photo")
+	require.NoError(t, err)
+	f, err := fh.Open()
+	require.NoError(t, err)
+	content, _ := io.ReadAll(f)
+	assert.Equal(t, "sand\r\nand --xYzZ sea", string(content))
+
+	tmpfile := files[1].tmpfile
+	require.NoError(t, r.MultipartForm.RemoveAll())
+	_, err = os.Stat(tmpfile)
+	assert.True(t, os.IsNotExist(err))
+
+	// Test: Field values beyond the memory budget
+	r, err = RequestFromReader(strings.NewReader(multipartRequest(
+		"--xYzZY\r\nContent-Disposition: form-data; name=\"big\"\r\n\r\n" + strings.Repeat("a", 100) + "\r\n--xYzZY--\r\n")))
+	require.NoError(t, err)
+	assert.ErrorIs(t, r.ParseMultipartForm(10), ErrMultipartLimits)
+
+	// Test: Missing closing delimiter
+	r, err = RequestFromReader(strings.NewReader(multipartRequest(
+		"--xYzZY\r\nContent-Disposition: form-data; name=\"a\"\r\n\r\nvalue")))
+	require.NoError(t, err)
+	assert.ErrorIs(t, r.ParseMultipartForm(1024), io.ErrUnexpectedEOF)
+
+	// Test: Not multipart
+	r, err = RequestFromReader(strings.NewReader("POST / HTTP/1.1\r\nContent-Length: 0\r\n\r\n"))
+	require.NoError(t, err)
+	assert.ErrorIs(t, r.ParseMultipartForm(1024), ErrNotMultipart)
+}
+
+func TestCookies(t *testing.T) {
+	r, err := RequestFromReader(strings.NewReader("GET / HTTP/1.1\r\nHost: localhost\r\nCookie: session=abc123; theme=dark\r\n\r\n"))
+	require.NoError(t, err)
+	require.Len(t, r.Cookies(), 2)
+
+	c, err := r.Cookie("theme")
+	require.NoError(t, err)
+	assert.Equal(t, "dark", c.Value)
+
+	_, err = r.Cookie("missing")
+	assert.ErrorIs(t, err, ErrNoCookie)
+}
+
+func TestRepeatedFramingHeaders(t *testing.T) {
+	// Test: Identical repeated Content-Length is fine
+	r, err := RequestFromReader(strings.NewReader("POST / HTTP/1.1\r\nContent-Length: 5\r\nContent-Length: 5\r\n\r\nhello"))
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(r.Body))
+
+	// Test: Conflicting Content-Length
+	_, err = RequestFromReader(strings.NewReader("POST / HTTP/1.1\r\nContent-Length: 5\r\nContent-Length: 6\r\n\r\nhello!"))
+	assert.ErrorIs(t, err, ErrMalformedRequest)
+
+	// Test: Signed Content-Length
+	for _, cl := range []string{"+5", "-0", "0x5"} {
+		_, err = RequestFromReader(strings.NewReader("POST / HTTP/1.1\r\nContent-Length: " + cl + "\r\n\r\nhello"))
+		assert.ErrorIs(t, err, ErrMalformedRequest, cl)
+	}
+
+	// Test: Transfer-Encoding split over two lines
+	_, err = RequestFromReader(strings.NewReader("POST / HTTP/1.1\r\nTransfer-Encoding: gzip\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n"))
+	assert.ErrorIs(t, err, ErrUnsupportedTransferCoding)
+}
+
+func TestOnHeaders(t *testing.T) {
+	// Test: Called once per request, before the body is read
+	reader := &chunkReader{
+		data: "POST /submit HTTP/1.1\r\n" +
+			"Content-Length: 5\r\n" +
+			"\r\n" +
+			"hello" +
+			"GET /next HTTP/1.1\r\n" +
+			"\r\n",
+		numBytesPerRead: 3,
+	}
+	var seen []string
+	p := NewParser(reader)
+	p.OnHeaders = func(req *Request) {
+		seen = append(seen, req.RequestLine.RequestTarget+" "+string(req.Body))
+	}
+	_, err := p.Next()
+	require.NoError(t, err)
+	_, err = p.Next()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"/submit ", "/next "}, seen)
+}
+
+func TestOnBodyDone(t *testing.T) {
+	data := "POST /submit HTTP/1.1\r\n" +
+		"Content-Length: 5\r\n" +
+		"\r\n" +
+		"hello" +
+		"POST /skipped HTTP/1.1\r\n" +
+		"Content-Length: 3\r\n" +
+		"\r\n" +
+		"abc" +
+		"GET /next HTTP/1.1\r\n" +
+		"\r\n"
+
+	// Test: Buffered bodies are done by the time Next returns
+	var seen []string
+	p := NewParser(&chunkReader{data: data, numBytesPerRead: 3})
+	p.OnBodyDone = func(req *Request) {
+		seen = append(seen, req.RequestLine.RequestTarget+" "+string(req.Body))
+	}
+	for range 3 {
+		req, err := p.Next()
+		require.NoError(t, err)
+		assert.True(t, req.BodyComplete())
+	}
+	assert.Equal(t, []string{"/submit hello", "/skipped abc", "/next "}, seen)
+
+	// Test: Streamed bodies once BodyReader reaches the end, not when Next skips them
+	seen = nil
+	p = NewParser(&chunkReader{data: data, numBytesPerRead: 3})
+	p.StreamBody = true
+	p.OnBodyDone = func(req *Request) {
+		seen = append(seen, req.RequestLine.RequestTarget)
+	}
+	req, err := p.Next()
+	require.NoError(t, err)
+	assert.False(t, req.BodyComplete())
+	assert.Empty(t, seen)
+	body, err := io.ReadAll(req.BodyReader)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(body))
+	assert.True(t, req.BodyComplete())
+	_, err = req.BodyReader.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+
+	_, err = p.Next()
+	require.NoError(t, err)
+	req, err = p.Next()
+	require.NoError(t, err)
+	assert.Equal(t, "/next", req.RequestLine.RequestTarget)
+	assert.Equal(t, []string{"/submit", "/next"}, seen)
+}
+
+func TestContext(t *testing.T) {
+	// Test: Background until something is set
+	req, err := RequestFromReader(strings.NewReader("GET / HTTP/1.1\r\n\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, context.Background(), req.Context())
+
+	// Test: Values attached by a handler are visible further down
+	type key struct{}
+	req.SetContext(context.WithValue(req.Context(), key{}, "v"))
+	assert.Equal(t, "v", req.Context().Value(key{}))
+
+	assert.Panics(t, func() { req.SetContext(nil) })
+}
+
+func TestPathValue(t *testing.T) {
+	req, err := RequestFromReader(strings.NewReader("GET /users/42 HTTP/1.1\r\n\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "", req.PathValue("id"))
+	req.SetPathValue("id", "42")
+	assert.Equal(t, "42", req.PathValue("id"))
+}
+
+func TestTLSInfo(t *testing.T) {
+	leaf := func(uris ...string) *x509.Certificate {
+		cert := &x509.Certificate{}
+		for _, u := range uris {
+			parsed, err := url.Parse(u)
+			require.NoError(t, err)
+			cert.URIs = append(cert.URIs, parsed)
+		}
+		return cert
+	}
+	verified := func(cert *x509.Certificate) tls.ConnectionState {
+		return tls.ConnectionState{
+			Version:          tls.VersionTLS13,
+			CipherSuite:      tls.TLS_AES_128_GCM_SHA256,
+			PeerCertificates: []*x509.Certificate{cert},
+			VerifiedChains:   [][]*x509.Certificate{{cert}},
+		}
+	}
+
+	// Test: SPIFFE ID among other URI SANs
+	info := NewTLSInfo(verified(leaf("https://example.org/", "spiffe://prod.example.org/ns/web/sa/frontend")))
+	assert.True(t, info.Verified)
+	assert.Equal(t, "spiffe://prod.example.org/ns/web/sa/frontend", info.SPIFFEID)
+	assert.Equal(t, "prod.example.org", info.TrustDomain())
+	assert.Len(t, info.URIs, 2)
+	assert.Equal(t, "TLS 1.3", info.VersionName())
+	assert.Equal(t, "TLS_AES_128_GCM_SHA256", info.CipherSuiteName())
+
+	// Test: Invalid SPIFFE IDs
+	for _, uri := range []string{
+		"spiffe://Example.org/api",
+		"spiffe://example.org:8443/api",
+		"spiffe://user@example.org/api",
+		"spiffe://example.org/api?x=1",
+		"spiffe://example.org/api#frag",
+		"spiffe:///api",
+	} {
+		assert.Empty(t, NewTLSInfo(verified(leaf(uri))).SPIFFEID, uri)
+	}
+
+	// Test: More than one SPIFFE ID
+	info = NewTLSInfo(verified(leaf("spiffe://example.org/a", "spiffe://example.org/b")))
+	assert.Empty(t, info.SPIFFEID)
+	assert.Empty(t, info.TrustDomain())
+
+	// Test: Unverified certificates don't count
+	state := verified(leaf("spiffe://example.org/api"))
+	state.VerifiedChains = nil
+	info = NewTLSInfo(state)
+	assert.False(t, info.Verified)
+	assert.Len(t, info.PeerCertificates, 1)
+	assert.Empty(t, info.SPIFFEID)
+	assert.Empty(t, info.URIs)
+}
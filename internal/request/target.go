@@ -0,0 +1,188 @@
+package request
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// The four shapes a request-target can take (RFC 9112 section 3.2).
+type TargetForm int
+
+const (
+	OriginForm    TargetForm = iota // /path?query
+	AbsoluteForm                    // http://host/path?query, mostly sent to proxies
+	AuthorityForm                   // host:port, only for CONNECT
+	AsteriskForm                    // *, only for server-wide OPTIONS
+)
+
+// Parsed form of RequestLine.RequestTarget.
+type URL struct {
+	Form     TargetForm
+	Scheme   string // Lowercased; absolute-form only
+	Host     string // host[:port]; absolute-form and authority-form only
+	Path     string // Percent-decoded path; empty for authority-form and asterisk-form
+	RawPath  string // Path exactly as sent
+	RawQuery string // Query without the leading "?", still encoded
+	Query    Query
+}
+
+// Multi-valued query parameters that remember the order keys first appeared in.
+type Query struct {
+	keys   []string
+	values map[string][]string
+}
+
+// Returns the first value for key, or "" if there is none.
+func (q Query) Get(key string) string {
+	if vals := q.values[key]; len(vals) > 0 {
+		return vals[0]
+	}
+	return ""
+}
+
+// Returns every value for key in the order they were sent.
+func (q Query) Values(key string) []string {
+	return q.values[key]
+}
+
+func (q Query) Has(key string) bool {
+	_, exists := q.values[key]
+	return exists
+}
+
+// Returns the distinct keys in the order they first appeared.
+func (q Query) Keys() []string {
+	return q.keys
+}
+
+func (q *Query) Add(key, val string) {
+	if q.values == nil {
+		q.values = make(map[string][]string)
+	}
+	if _, exists := q.values[key]; !exists {
+		q.keys = append(q.keys, key)
+	}
+	q.values[key] = append(q.values[key], val)
+}
+
+// Parses an application/x-www-form-urlencoded string such as a URL query.
+func ParseQuery(raw string) (Query, error) {
+	var q Query
+	for _, pair := range strings.Split(raw, "&") {
+		if pair == "" {
+			continue
+		}
+		rawKey, rawVal, _ := strings.Cut(pair, "=")
+		key, err := url.QueryUnescape(rawKey)
+		if err != nil {
+			return Query{}, fmt.Errorf("invalid query key %q: %w", rawKey, err)
+		}
+		val, err := url.QueryUnescape(rawVal)
+		if err != nil {
+			return Query{}, fmt.Errorf("invalid query value %q: %w", rawVal, err)
+		}
+		q.Add(key, val)
+	}
+	return q, nil
+}
+
+// Parses a request-target, checking that its form is allowed for method.
+func ParseTarget(method, target string) (*URL, error) {
+	if target == "" {
+		return nil, errors.New("empty request target")
+	}
+	for _, ch := range []byte(target) {
+		if ch <= ' ' || ch == 0x7f {
+			return nil, errors.New("control character in request target")
+		}
+	}
+	// Fragments are for the client only and are never sent on the wire
+	if strings.Contains(target, "#") {
+		return nil, errors.New("fragment in request target")
+	}
+
+	switch {
+	case method == "CONNECT":
+		if !isAuthority(target) {
+			return nil, fmt.Errorf("CONNECT needs host:port, got %q", target)
+		}
+		return &URL{Form: AuthorityForm, Host: target}, nil
+
+	case target == "*":
+		if method != "OPTIONS" {
+			return nil, fmt.Errorf("asterisk-form is only allowed for OPTIONS, not %s", method)
+		}
+		return &URL{Form: AsteriskForm}, nil
+
+	case strings.HasPrefix(target, "/"):
+		u := &URL{Form: OriginForm}
+		if err := u.setPathAndQuery(target); err != nil {
+			return nil, err
+		}
+		return u, nil
+	}
+
+	scheme, rest, ok := strings.Cut(target, "://")
+	scheme = strings.ToLower(scheme)
+	if !ok || (scheme != "http" && scheme != "https") {
+		return nil, fmt.Errorf("unsupported request target %q", target)
+	}
+
+	host := rest
+	pathAndQuery := "/"
+	if i := strings.IndexAny(rest, "/?"); i != -1 {
+		host = rest[:i]
+		pathAndQuery = rest[i:]
+		if strings.HasPrefix(pathAndQuery, "?") {
+			pathAndQuery = "/" + pathAndQuery
+		}
+	}
+	if host == "" || strings.Contains(host, "@") {
+		return nil, fmt.Errorf("invalid host in request target %q", target)
+	}
+
+	u := &URL{Form: AbsoluteForm, Scheme: scheme, Host: host}
+	if err := u.setPathAndQuery(pathAndQuery); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+func (u *URL) setPathAndQuery(s string) error {
+	rawPath, rawQuery, _ := strings.Cut(s, "?")
+
+	path, err := url.PathUnescape(rawPath)
+	if err != nil {
+		return fmt.Errorf("invalid path %q: %w", rawPath, err)
+	}
+	query, err := ParseQuery(rawQuery)
+	if err != nil {
+		return err
+	}
+
+	u.Path = path
+	u.RawPath = rawPath
+	u.RawQuery = rawQuery
+	u.Query = query
+	return nil
+}
+
+// Checks for the uri-host ":" port shape CONNECT requires, including bracketed IPv6 hosts.
+func isAuthority(s string) bool {
+	i := strings.LastIndex(s, ":")
+	if i <= 0 || i == len(s)-1 {
+		return false
+	}
+	host, port := s[:i], s[i+1:]
+	for _, ch := range port {
+		if ch < '0' || ch > '9' {
+			return false
+		}
+	}
+	if strings.HasPrefix(host, "[") {
+		return strings.HasSuffix(host, "]") && len(host) > 2
+	}
+	return !strings.ContainsAny(host, "/?@[]")
+}
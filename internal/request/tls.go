@@ -0,0 +1,87 @@
+package request
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/url"
+)
+
+// TLS details of the connection a request came in on.
+type TLSInfo struct {
+	Version     uint16 // e.g. tls.VersionTLS13
+	CipherSuite uint16
+	ServerName  string // Name the client asked for through SNI
+
+	// Client certificates as presented, leaf first. Only trustworthy if Verified: with
+	// tls.RequestClientCert or tls.RequireAnyClientCert nothing checks them.
+	PeerCertificates []*x509.Certificate
+	// Chains from the client certificate to a trusted CA. Empty unless Verified.
+	VerifiedChains [][]*x509.Certificate
+	Verified       bool
+
+	// URI SANs of the verified client certificate
+	URIs []*url.URL
+	// SPIFFE ID of the verified client certificate, e.g. spiffe://example.org/ns/prod/sa/api.
+	// Empty if the certificate doesn't carry exactly one valid one.
+	SPIFFEID string
+}
+
+// Collects what handlers need from the state of a completed handshake.
+func NewTLSInfo(state tls.ConnectionState) *TLSInfo {
+	info := &TLSInfo{
+		Version:          state.Version,
+		CipherSuite:      state.CipherSuite,
+		ServerName:       state.ServerName,
+		PeerCertificates: state.PeerCertificates,
+		VerifiedChains:   state.VerifiedChains,
+		Verified:         len(state.VerifiedChains) > 0,
+	}
+	if !info.Verified {
+		return info
+	}
+
+	info.URIs = state.VerifiedChains[0][0].URIs
+	for _, uri := range info.URIs {
+		if uri.Scheme != "spiffe" {
+			continue
+		}
+		// An SVID has exactly one SPIFFE ID, a certificate claiming more is not one
+		if info.SPIFFEID != "" || !validSPIFFEID(uri) {
+			info.SPIFFEID = ""
+			break
+		}
+		info.SPIFFEID = uri.String()
+	}
+	return info
+}
+
+func (t *TLSInfo) VersionName() string {
+	return tls.VersionName(t.Version)
+}
+
+func (t *TLSInfo) CipherSuiteName() string {
+	return tls.CipherSuiteName(t.CipherSuite)
+}
+
+// Returns the trust domain of the SPIFFE ID, e.g. example.org, or "" if there is none.
+func (t *TLSInfo) TrustDomain() string {
+	if t.SPIFFEID == "" {
+		return ""
+	}
+	uri, _ := url.Parse(t.SPIFFEID)
+	return uri.Host
+}
+
+// Checks the rules of the SPIFFE ID spec: a lower case trust domain without port or user
+// info, and no query or fragment.
+func validSPIFFEID(uri *url.URL) bool {
+	if uri.Host == "" || uri.Port() != "" || uri.User != nil || uri.RawQuery != "" || uri.Fragment != "" || uri.Opaque != "" {
+		return false
+	}
+	for _, ch := range uri.Host {
+		if !(ch >= 'a' && ch <= 'z' || ch >= '0' && ch <= '9' || ch == '.' || ch == '-' || ch == '_') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,146 @@
+package response
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/boxy-pug/httpfromtcp/internal/headers"
+)
+
+var ErrEncoderClosed = errors.New("chunked encoder already closed")
+
+// Fields that must not be sent as trailers because recipients need them before the body
+// (framing, routing, authentication, content handling) or they control the trailer itself.
+// See RFC 9110 section 6.5.1.
+var forbiddenTrailers = map[string]bool{
+	"Age":                 true,
+	"Authorization":       true,
+	"Cache-Control":       true,
+	"Content-Encoding":    true,
+	"Content-Length":      true,
+	"Content-Range":       true,
+	"Content-Type":        true,
+	"Date":                true,
+	"Expect":              true,
+	"Expires":             true,
+	"Host":                true,
+	"If-Match":            true,
+	"If-Modified-Since":   true,
+	"If-None-Match":       true,
+	"If-Range":            true,
+	"If-Unmodified-Since": true,
+	"Location":            true,
+	"Max-Forwards":        true,
+	"Pragma":              true,
+	"Proxy-Authenticate":  true,
+	"Proxy-Authorization": true,
+	"Range":               true,
+	"Retry-After":         true,
+	"Set-Cookie":          true,
+	"Te":                  true,
+	"Trailer":             true,
+	"Transfer-Encoding":   true,
+	"Vary":                true,
+	"Www-Authenticate":    true,
+}
+
+// Writes a body with chunked transfer coding (RFC 9112 section 7.1). Every Write becomes one
+// chunk; Close writes the last-chunk, the trailer section and the final CRLF in one go, so
+// the framing can't end up out of order or duplicated.
+type ChunkedEncoder struct {
+	// Write trailer names exactly as given instead of in canonical form.
+	RawHeaderCase bool
+
+	w        io.Writer
+	declared map[string]bool // Canonical names announced in the Trailer header
+	closed   bool
+}
+
+// Creates an encoder for w. declared lists the field names announced in the response's
+// Trailer header; only those can be sent by Close.
+func NewChunkedEncoder(w io.Writer, declared []string) (*ChunkedEncoder, error) {
+	c := &ChunkedEncoder{w: w, declared: make(map[string]bool)}
+	for _, name := range declared {
+		if err := checkTrailerName(name); err != nil {
+			return nil, err
+		}
+		c.declared[headers.CanonicalKey(name)] = true
+	}
+	return c, nil
+}
+
+// Splits a Trailer header value into field names.
+func TrailerNames(h *headers.Headers) []string {
+	var names []string
+	for _, val := range h.Values("Trailer") {
+		for _, name := range strings.Split(val, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, name)
+			}
+		}
+	}
+	return names
+}
+
+// Writes p as a single chunk. Empty writes are skipped, since a zero-sized chunk
+// would read as the last-chunk.
+func (c *ChunkedEncoder) Write(p []byte) (int, error) {
+	if c.closed {
+		return 0, ErrEncoderClosed
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	// Create the chunked format
+	chunk := []byte(fmt.Sprintf("%x\r\n", len(p)))
+	chunk = append(chunk, p...)
+	chunk = append(chunk, []byte("\r\n")...)
+
+	if _, err := c.w.Write(chunk); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Ends the body: last-chunk, trailer fields, final CRLF. trailers may be nil. Fails without
+// writing anything if a trailer wasn't declared or can't be written safely.
+func (c *ChunkedEncoder) Close(trailers *headers.Headers) error {
+	if c.closed {
+		return ErrEncoderClosed
+	}
+
+	var err error
+	trailers.Range(func(name, _ string) bool {
+		if !c.declared[headers.CanonicalKey(name)] {
+			err = fmt.Errorf("trailer %q not declared in Trailer header", name)
+		}
+		return err == nil
+	})
+	if err != nil {
+		return err
+	}
+
+	end := []byte("0\r\n")
+	end, err = appendFields(end, trailers, c.RawHeaderCase)
+	if err != nil {
+		return err
+	}
+	end = append(end, []byte("\r\n")...)
+
+	c.closed = true
+	_, err = c.w.Write(end)
+	return err
+}
+
+func checkTrailerName(name string) error {
+	if !headers.ValidName(name) {
+		return fmt.Errorf("invalid trailer name %q", name)
+	}
+	if forbiddenTrailers[headers.CanonicalKey(name)] {
+		return fmt.Errorf("%q is not allowed as a trailer", name)
+	}
+	return nil
+}
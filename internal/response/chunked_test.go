@@ -0,0 +1,185 @@
+package response
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/boxy-pug/httpfromtcp/internal/headers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChunkedEncoder(t *testing.T) {
+	// Test: Chunks and last-chunk without trailers
+	var buf bytes.Buffer
+	c, err := NewChunkedEncoder(&buf, nil)
+	require.NoError(t, err)
+	n, err := c.Write([]byte("hello"))
+	require.NoError(t, err)
+	assert.Equal(t, 5, n)
+	n, err = c.Write(nil)
+	require.NoError(t, err)
+	assert.Equal(t, 0, n)
+	_, err = c.Write([]byte(" world, this is chunk two"))
+	require.NoError(t, err)
+	require.NoError(t, c.Close(nil))
+	assert.Equal(t, "5\r\nhello\r\n19\r\n world, this is chunk two\r\n0\r\n\r\n", buf.String())
+
+	// Test: Nothing after Close
+	_, err = c.Write([]byte("late"))
+	assert.ErrorIs(t, err, ErrEncoderClosed)
+	assert.ErrorIs(t, c.Close(nil), ErrEncoderClosed)
+	assert.Equal(t, "5\r\nhello\r\n19\r\n world, this is chunk two\r\n0\r\n\r\n", buf.String())
+
+	// Test: Declared trailers in canonical form
+	buf.Reset()
+	c, err = NewChunkedEncoder(&buf, []string{"x-content-sha256", "X-Content-Length"})
+	require.NoError(t, err)
+	c.Write([]byte("abc"))
+	trailers := headers.NewHeaders()
+	trailers.Set("X-Content-Sha256", "ba7816bf")
+	trailers.Set("x-content-length", "3")
+	require.NoError(t, c.Close(trailers))
+	assert.Equal(t, "3\r\nabc\r\n0\r\nX-Content-Sha256: ba7816bf\r\nX-Content-Length: 3\r\n\r\n", buf.String())
+
+	// Test: Undeclared trailer is refused and nothing is written
+	buf.Reset()
+	c, err = NewChunkedEncoder(&buf, []string{"X-Checksum"})
+	require.NoError(t, err)
+	trailers = headers.NewHeaders()
+	trailers.Set("X-Other", "1")
+	assert.Error(t, c.Close(trailers))
+	assert.Equal(t, "", buf.String())
+
+	// Test: Trailer values can't inject lines
+	trailers = headers.NewHeaders()
+	trailers.Set("X-Checksum", "1\r\n\r\nHTTP/1.1 200 OK")
+	assert.Error(t, c.Close(trailers))
+	assert.Equal(t, "", buf.String())
+
+	// Test: Failed Close can be retried
+	require.NoError(t, c.Close(nil))
+	assert.Equal(t, "0\r\n\r\n", buf.String())
+
+	// Test: Forbidden trailer names can't be declared
+	_, err = NewChunkedEncoder(&buf, []string{"Content-Length"})
+	assert.Error(t, err)
+	_, err = NewChunkedEncoder(&buf, []string{"set-cookie"})
+	assert.Error(t, err)
+	_, err = NewChunkedEncoder(&buf, []string{"bad name"})
+	assert.Error(t, err)
+}
+
+func TestWriterChunked(t *testing.T) {
+	chunkedHeaders := func(trailer string) *headers.Headers {
+		h := headers.NewHeaders()
+		h.Set("Content-Type", "text/plain")
+		h.Set("Transfer-Encoding", "chunked")
+		if trailer != "" {
+			h.Set("Trailer", trailer)
+		}
+		return h
+	}
+
+	// Test: Full response with trailers
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	w.WriteStatusLine(OK)
+	require.NoError(t, w.WriteHeaders(chunkedHeaders("X-Content-Sha256, X-Content-Length")))
+	_, err := w.WriteChunkedBody([]byte("hello "))
+	require.NoError(t, err)
+	_, err = w.WriteBody([]byte("world"))
+	require.NoError(t, err)
+	_, err = w.WriteChunkedBodyDone()
+	require.NoError(t, err)
+	trailers := headers.NewHeaders()
+	trailers.Set("X-Content-Sha256", "abc")
+	trailers.Set("X-Content-Length", "11")
+	require.NoError(t, w.WriteTrailers(trailers))
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n"+
+		"Content-Type: text/plain\r\n"+
+		"Transfer-Encoding: chunked\r\n"+
+		"Trailer: X-Content-Sha256, X-Content-Length\r\n"+
+		"\r\n"+
+		"6\r\nhello \r\n"+
+		"5\r\nworld\r\n"+
+		"0\r\n"+
+		"X-Content-Sha256: abc\r\n"+
+		"X-Content-Length: 11\r\n"+
+		"\r\n", buf.String())
+	assert.True(t, w.KeepAlive())
+
+	// Test: Finish terminates a chunked body the handler left open
+	buf.Reset()
+	w = NewWriter(&buf)
+	w.WriteStatusLine(OK)
+	w.WriteHeaders(chunkedHeaders(""))
+	w.WriteBody([]byte("data"))
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\nTransfer-Encoding: chunked\r\n\r\n4\r\ndata\r\n0\r\n\r\n", buf.String())
+	assert.True(t, w.KeepAlive())
+
+	// Test: Content-Length set along with chunked is dropped
+	buf.Reset()
+	w = NewWriter(&buf)
+	w.WriteStatusLine(OK)
+	h := chunkedHeaders("")
+	h.Set("Content-Length", "10")
+	require.NoError(t, w.WriteHeaders(h))
+	w.WriteBody([]byte("data"))
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\nTransfer-Encoding: chunked\r\n\r\n4\r\ndata\r\n0\r\n\r\n", buf.String())
+	assert.True(t, w.KeepAlive())
+
+	// Test: Chunked framing only when chunked is the last coding
+	buf.Reset()
+	w = NewWriter(&buf)
+	w.WriteStatusLine(OK)
+	h = headers.NewHeaders()
+	h.Set("Transfer-Encoding", "chunked, gzip")
+	h.Set("Content-Length", "4")
+	require.NoError(t, w.WriteHeaders(h))
+	w.WriteBody([]byte("data"))
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked, gzip\r\nConnection: close\r\n\r\ndata", buf.String())
+	assert.False(t, w.KeepAlive())
+	buf.Reset()
+	w = NewWriter(&buf)
+	w.WriteStatusLine(OK)
+	h = headers.NewHeaders()
+	h.Add("Transfer-Encoding", "gzip")
+	h.Add("Transfer-Encoding", "Chunked")
+	require.NoError(t, w.WriteHeaders(h))
+	w.WriteBody([]byte("data"))
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nTransfer-Encoding: gzip\r\nTransfer-Encoding: Chunked\r\n\r\n4\r\ndata\r\n0\r\n\r\n", buf.String())
+	assert.True(t, w.KeepAlive())
+
+	// Test: Finish after WriteChunkedBodyDone without trailers, and after a refused trailer
+	buf.Reset()
+	w = NewWriter(&buf)
+	w.WriteStatusLine(OK)
+	w.WriteHeaders(chunkedHeaders("X-Checksum"))
+	w.WriteChunkedBodyDone()
+	trailers = headers.NewHeaders()
+	trailers.Set("X-Undeclared", "1")
+	assert.Error(t, w.WriteTrailers(trailers))
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\nTransfer-Encoding: chunked\r\nTrailer: X-Checksum\r\n\r\n0\r\n\r\n", buf.String())
+
+	// Test: Chunks and trailers only fit in a chunked body
+	w = NewWriter(&buf)
+	w.WriteStatusLine(OK)
+	w.WriteHeaders(GetDefaultHeaders(3))
+	_, err = w.WriteChunkedBody([]byte("abc"))
+	assert.ErrorIs(t, err, ErrWriteOrder)
+	_, err = w.WriteChunkedBodyDone()
+	assert.ErrorIs(t, err, ErrWriteOrder)
+	assert.ErrorIs(t, w.WriteTrailers(nil), ErrWriteOrder)
+
+	// Test: Forbidden trailer declaration fails the headers
+	w = NewWriter(&buf)
+	w.WriteStatusLine(OK)
+	assert.Error(t, w.WriteHeaders(chunkedHeaders("Content-Length")))
+}
@@ -1,142 +1,438 @@
 package response
 
 import (
+	"bufio"
+	"errors"
 	"fmt"
-	"net/http"
+	"io"
 	"strconv"
+	"strings"
 
+	"github.com/boxy-pug/httpfromtcp/internal/cookie"
 	"github.com/boxy-pug/httpfromtcp/internal/headers"
 )
 
-type StatusCode int
+// A response is written in a fixed order: status line, headers, body, and for chunked
+// bodies the last-chunk and trailers. Each Write method checks it is called in its turn.
+type writerState int
 
 const (
-	OK            StatusCode = 200
-	BadRequest    StatusCode = 400
-	InternalError StatusCode = 500
+	writerStateStatusLine writerState = iota
+	writerStateHeaders
+	writerStateBody
+	writerStateTrailers
+	writerStateDone
 )
 
+var (
+	ErrWriteOrder     = errors.New("response parts written out of order")
+	ErrContentLength  = errors.New("body longer than declared Content-Length")
+	ErrBodyNotAllowed = errors.New("response status does not allow a body")
+)
+
+// Writes a response straight to the connection through a buffer. Nothing reaches the
+// client until the buffer fills up, Flush is called or the server finishes the response.
 type Writer struct {
-	Headers    headers.Headers
+	Headers    *headers.Headers // Headers as written by WriteHeaders
 	StatusCode StatusCode
-	StatusLine []byte
-	Body       []byte
-	httpWriter http.ResponseWriter
+
+	// Write header and trailer names exactly as given instead of in canonical form.
+	RawHeaderCase bool
+	// Drop the body instead of sending it, as in a response to HEAD. The headers still
+	// describe the body a GET would get, and its length is still checked against them.
+	OmitBody bool
+
+	bw         *bufio.Writer
+	state      writerState
+	statusLine []byte // Held back until the header section so a refused one can become a 500
+	refused    bool   // The last WriteHeaders call failed validation
+	cookies    []*cookie.Cookie
+	closeAfter bool            // Connection won't be reused, announce Connection: close
+	chunks     *ChunkedEncoder // Set if the body uses chunked transfer coding
+	remaining  int64           // Body bytes still owed under Content-Length, -1 if none declared
+	err        error           // First write error, returned by every later call
 }
 
-func NewWriter(httpWriter http.ResponseWriter) *Writer {
+func NewWriter(w io.Writer) *Writer {
 	return &Writer{
-		httpWriter: httpWriter,
-		Headers:    make(headers.Headers),
-		// Initialize any other fields you need
+		bw:        bufio.NewWriter(w),
+		remaining: -1,
 	}
 }
 
+// Writes the status line with the registered reason phrase for statusCode. It goes out
+// together with the header section, or on Flush. A 1xx status other than 101 is an interim
+// response: once its headers are written the writer expects the status line of the final
+// response.
 func (w *Writer) WriteStatusLine(statusCode StatusCode) error {
-	switch statusCode {
-	case OK:
-		w.StatusLine = []byte("HTTP/1.1 200 OK\r\n")
-	case BadRequest:
-		w.StatusLine = []byte("HTTP/1.1 400 Bad Request\r\n")
-	case InternalError:
-		w.StatusLine = []byte("HTTP/1.1 500 Internal Server Error\r\n")
-	default:
-		w.StatusLine = []byte("HTTP/1.1 XXX \r\n")
+	return w.WriteStatusLineReason(statusCode, StatusText(statusCode))
+}
+
+// Like WriteStatusLine with a reason phrase of our own. The phrase may be empty.
+func (w *Writer) WriteStatusLineReason(statusCode StatusCode, reason string) error {
+	if w.state != writerStateStatusLine {
+		return fmt.Errorf("%w: status line already written", ErrWriteOrder)
 	}
-	return nil
+	if statusCode < 100 || statusCode > 599 {
+		return fmt.Errorf("invalid status code %d", statusCode)
+	}
+	if !headers.ValidValue(reason) {
+		return fmt.Errorf("invalid reason phrase %q", reason)
+	}
+	w.state = writerStateHeaders
+	w.StatusCode = statusCode
+	w.statusLine = []byte(fmt.Sprintf("HTTP/1.1 %d %s\r\n", statusCode, reason))
+	return w.err
 }
 
-func GetDefaultHeaders(contentLen int) headers.Headers {
+func GetDefaultHeaders(contentLen int) *headers.Headers {
 	strLen := strconv.Itoa(contentLen)
-	return headers.Headers{
-		"Content-Length": strLen,
-		"Connection":     "close",
-		"Content-Type":   "text/plain",
+	h := headers.NewHeaders()
+	h.Set("Content-Length", strLen)
+	h.Set("Content-Type", "text/plain")
+	return h
+}
+
+// Writes the header section. Fails without writing anything if a name or value could not
+// be written safely. Adds Connection: close when the connection won't be reused, including
+// when the body has neither a Content-Length nor chunked framing. The body is chunked only
+// if chunked is the last transfer coding, any other coding runs until the connection
+// closes. Transfer-Encoding drops any Content-Length, the two must not be sent together.
+// Content-Length and
+// Transfer-Encoding are dropped for 1xx and 204 responses, which must not send them; a 304
+// keeps its Content-Length but, like them, never gets a body.
+func (w *Writer) WriteHeaders(h *headers.Headers) error {
+	if w.state != writerStateHeaders {
+		return fmt.Errorf("%w: headers written before the status line or twice", ErrWriteOrder)
+	}
+	err := w.writeHeaders(h)
+	// Still waiting for headers means they were refused rather than lost on the way out
+	w.refused = err != nil && w.state == writerStateHeaders
+	return err
+}
+
+func (w *Writer) writeHeaders(h *headers.Headers) error {
+	if h == nil {
+		h = headers.NewHeaders()
+	}
+	if err := checkFields(h); err != nil {
+		return err
+	}
+	if w.StatusCode.interim() {
+		return w.writeInterim(h)
+	}
+
+	bodyless := w.StatusCode.bodyless()
+	if bodyless && w.StatusCode != NotModified {
+		h.Del("Content-Length")
+		h.Del("Transfer-Encoding")
+	}
+	if !bodyless && len(h.Values("Transfer-Encoding")) > 0 {
+		// Both framings at once would let whoever forwards the response pick one
+		h.Del("Content-Length")
 	}
+	chunked := !bodyless && strings.EqualFold(lastCoding(h), "chunked")
+	var chunks *ChunkedEncoder
+	if chunked {
+		var err error
+		var dst io.Writer = writeFunc(w.writeRaw)
+		if w.OmitBody {
+			dst = io.Discard
+		}
+		if chunks, err = NewChunkedEncoder(dst, TrailerNames(h)); err != nil {
+			return err
+		}
+		chunks.RawHeaderCase = w.RawHeaderCase
+	}
+	remaining := int64(-1)
+	if bodyless {
+		remaining = 0
+	} else if cl := h.Get("Content-Length"); cl != "" {
+		// Same rules as for requests: 1*DIGIT, and repeated copies must agree
+		for _, val := range h.Values("Content-Length") {
+			if val != cl {
+				return fmt.Errorf("conflicting Content-Length values %q and %q", cl, val)
+			}
+		}
+		n, err := strconv.ParseInt(cl, 10, 64)
+		if err != nil || !isDigits(cl) {
+			return fmt.Errorf("invalid Content-Length %q", cl)
+		}
+		remaining = n
+	}
+
+	w.state = writerStateBody
+	w.Headers = h
+	w.chunks = chunks
+	w.remaining = remaining
+
+	// Without explicit framing the client can only find the end of the body by EOF
+	if h.HasToken("Connection", "close") || (chunks == nil && w.remaining < 0 && !w.OmitBody) {
+		w.closeAfter = true
+	}
+	if w.closeAfter {
+		h.Set("Connection", "close")
+	}
+
+	block, err := appendFields(w.statusLine, h, w.RawHeaderCase)
+	if err != nil {
+		return err
+	}
+	w.statusLine = nil
+	// Each cookie needs its own Set-Cookie line, values may contain commas
+	for _, c := range w.cookies {
+		block = append(block, []byte("Set-Cookie: "+c.String()+"\r\n")...)
+	}
+	block = append(block, []byte("\r\n")...)
+	if w.StatusCode == SwitchingProtocols {
+		// The connection no longer speaks HTTP and we have nothing to switch to
+		w.closeAfter = true
+	}
+	return w.write(block)
 }
 
-func (w *Writer) WriteHeaders(headers headers.Headers) error {
-	w.Headers = headers
+// Writes the header section of an interim response and flushes it, since the client may be
+// waiting for it (e.g. 100 Continue) before it sends anything more. Cookies and framing are
+// left for the final response.
+func (w *Writer) writeInterim(h *headers.Headers) error {
+	block, err := appendFields(w.statusLine, h, w.RawHeaderCase)
+	if err != nil {
+		return err
+	}
+	block = append(block, []byte("\r\n")...)
+	w.statusLine = nil
+	w.state = writerStateStatusLine
+	if err := w.write(block); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// Adds a Set-Cookie header for c. Must be called before WriteHeaders.
+func (w *Writer) SetCookie(c *cookie.Cookie) error {
+	if w.state > writerStateHeaders {
+		return fmt.Errorf("%w: cookie set after headers", ErrWriteOrder)
+	}
+	if err := c.Valid(); err != nil {
+		return err
+	}
+	w.cookies = append(w.cookies, c)
 	return nil
 }
 
+// Writes body bytes. Can be called any number of times. For a chunked response each call
+// becomes one chunk.
 func (w *Writer) WriteBody(p []byte) (int, error) {
-	w.Body = p
-	// Implementation here
+	if w.state != writerStateBody {
+		return 0, fmt.Errorf("%w: body written before headers or after the end", ErrWriteOrder)
+	}
+	if w.chunks != nil {
+		return w.chunks.Write(p)
+	}
+	if w.StatusCode.bodyless() && len(p) > 0 {
+		return 0, ErrBodyNotAllowed
+	}
+	if w.remaining >= 0 {
+		if int64(len(p)) > w.remaining {
+			return 0, ErrContentLength
+		}
+		w.remaining -= int64(len(p))
+	}
+	if w.OmitBody {
+		return len(p), w.err
+	}
+	if err := w.write(p); err != nil {
+		return 0, err
+	}
 	return len(p), nil
 }
 
-func (w *Writer) AssembleResponse() []byte {
-	var resp []byte
-
-	// write statusline
-	resp = append(resp, w.StatusLine...)
+// Sends everything buffered so far to the client.
+func (w *Writer) Flush() error {
+	if w.statusLine != nil {
+		w.write(w.statusLine)
+		w.statusLine = nil
+	}
+	if w.err != nil {
+		return w.err
+	}
+	w.err = w.bw.Flush()
+	return w.err
+}
 
-	// write headers
-	for key, val := range w.Headers {
-		headerLine := fmt.Sprintf("%s: %s\r\n", key, val)
-		resp = append(resp, []byte(headerLine)...)
+// Marks the connection for closing after this response, so the header section
+// announces Connection: close. Has no effect once the headers are written.
+func (w *Writer) CloseAfterResponse() {
+	if w.state <= writerStateHeaders {
+		w.closeAfter = true
 	}
-	resp = append(resp, []byte("\r\n")...)
+}
 
-	// write body
-	resp = append(resp, w.Body...)
+// Reports whether another request can follow this response on the connection: nobody
+// asked to close, the body was framed and it was written out completely.
+func (w *Writer) KeepAlive() bool {
+	return !w.closeAfter && w.err == nil && w.state == writerStateDone
+}
 
-	return resp
+// Reports whether any part of the response has been written yet. Interim responses don't
+// count once they are complete, a final response can still follow them.
+func (w *Writer) Written() bool {
+	return w.state != writerStateStatusLine
+}
 
+// Completes whatever the handler left unfinished and flushes: a missing status line becomes
+// 200 OK, missing headers an empty header section with Content-Length: 0, an open chunked
+// body gets its last-chunk and final CRLF. If the handler's headers were refused, it gets a
+// 500 instead, or just the empty header section if its status line was flushed already,
+// and the connection is closed. A Content-Length body that came up short can't be repaired,
+// so the connection is marked for closing instead, unless the body is omitted.
+func (w *Writer) Finish() error {
+	refused := w.state == writerStateHeaders && w.refused
+	if refused {
+		w.closeAfter = true
+		if w.statusLine != nil {
+			w.statusLine = nil
+			w.state = writerStateStatusLine
+		}
+	}
+	if w.state == writerStateHeaders && w.StatusCode.interim() {
+		w.WriteHeaders(nil)
+	}
+	if w.state == writerStateStatusLine {
+		if refused {
+			w.WriteStatusLine(InternalError)
+		} else {
+			w.WriteStatusLine(OK)
+		}
+	}
+	if w.state == writerStateHeaders {
+		if w.StatusCode.bodyless() {
+			w.WriteHeaders(nil)
+		} else {
+			w.WriteHeaders(GetDefaultHeaders(0))
+		}
+	}
+	if w.state == writerStateBody && w.chunks != nil {
+		w.WriteChunkedBodyDone()
+	}
+	if w.state == writerStateTrailers {
+		w.WriteTrailers(nil)
+	}
+	if w.state == writerStateBody && w.remaining > 0 && !w.OmitBody {
+		w.closeAfter = true
+	}
+	w.state = writerStateDone
+	return w.Flush()
 }
 
-func (w *Writer) WriteChunkedBody(p []byte) (int, error) {
-	// Create the chunked format
-	chunkSize := fmt.Sprintf("%x", len(p))
-	// log.Printf("Chunk written to httpWriter: Size: %s, Data: %q\n", chunkSize, p)
-	chunk := []byte(chunkSize + "\r\n")
-	chunk = append(chunk, p...)
-	chunk = append(chunk, []byte("\r\n")...)
+// Returns the last coding listed in Transfer-Encoding, or "" if there is none. Only that
+// one says how the body is framed.
+func lastCoding(h *headers.Headers) string {
+	vals := h.Values("Transfer-Encoding")
+	if len(vals) == 0 {
+		return ""
+	}
+	codings := strings.Split(vals[len(vals)-1], ",")
+	return strings.TrimSpace(codings[len(codings)-1])
+}
 
-	// If httpWriter is nil, just store the data for later use in AssembleResponse
-	if w.httpWriter == nil {
-		w.Body = append(w.Body, chunk...)
-		return len(p), nil
+// Reports whether s is a non-empty run of ASCII digits.
+func isDigits(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
 	}
+	return true
+}
 
-	// Otherwise write directly to the httpWriter
-	return w.httpWriter.Write(chunk)
+// Appends h as field lines in insertion order, shared by the header and trailer sections.
+// Names are put in canonical form unless raw is set.
+func appendFields(dst []byte, h *headers.Headers, raw bool) ([]byte, error) {
+	if err := checkFields(h); err != nil {
+		return nil, err
+	}
+	h.Range(func(key, val string) bool {
+		if !raw {
+			key = headers.CanonicalKey(key)
+		}
+		dst = append(dst, key...)
+		dst = append(dst, ": "...)
+		dst = append(dst, val...)
+		dst = append(dst, "\r\n"...)
+		return true
+	})
+	return dst, nil
 }
 
-func (w *Writer) WriteChunkedBodyDone() (int, error) {
-	// Add the terminating chunk: 0 + CRLF + CRLF
-	w.Body = append(w.Body, []byte("0\r\n")...)
+// Refuses names and values that would break the message framing, e.g. a value with a CRLF
+// that smuggles in an extra header.
+func checkFields(h *headers.Headers) error {
+	var err error
+	h.Range(func(key, val string) bool {
+		if !headers.ValidName(key) {
+			err = fmt.Errorf("invalid header name %q", key)
+		} else if !headers.ValidValue(val) {
+			err = fmt.Errorf("invalid value for header %q", key)
+		}
+		return err == nil
+	})
+	return err
+}
 
-	// terminatingChunk := []byte("0\r\n\r\n")
+func (w *Writer) WriteChunkedBody(p []byte) (int, error) {
+	if w.state != writerStateBody || w.chunks == nil {
+		return 0, fmt.Errorf("%w: chunk written outside a chunked body", ErrWriteOrder)
+	}
+	return w.chunks.Write(p)
+}
 
-	//n, err := w.httpWriter.Write(terminatingChunk)
-	//if err != nil {
-	//	return n, err
-	//}
+// Ends the chunk data. Nothing is written yet: the last-chunk goes out together with the
+// trailer section from WriteTrailers, or with an empty one from Finish.
+func (w *Writer) WriteChunkedBodyDone() (int, error) {
+	if w.state != writerStateBody || w.chunks == nil {
+		return 0, fmt.Errorf("%w: chunked body ended outside a chunked body", ErrWriteOrder)
+	}
+	w.state = writerStateTrailers
+	return 0, nil
+}
 
-	// Make sure to set the Transfer-Encoding header
-	w.Headers["Transfer-Encoding"] = "chunked"
+// Writes the last-chunk and the trailer section. Every trailer must have been declared in
+// the Trailer response header.
+func (w *Writer) WriteTrailers(trailerHeaders *headers.Headers) error {
+	if w.state != writerStateTrailers {
+		return fmt.Errorf("%w: trailers written before the chunked body ended", ErrWriteOrder)
+	}
+	if err := w.chunks.Close(trailerHeaders); err != nil {
+		return err
+	}
+	w.state = writerStateDone
+	return w.err
+}
 
-	// Remove Content-Length if it exists, as they shouldn't be used together
-	delete(w.Headers, "Content-Length")
+type writeFunc func(p []byte) (int, error)
 
-	return 0, nil
+func (f writeFunc) Write(p []byte) (int, error) {
+	return f(p)
 }
 
-func (w *Writer) WriteTrailers(trailerHeaders headers.Headers) error {
-	var trailerData []byte
-	for key, val := range trailerHeaders {
-		trailerLine := fmt.Sprintf("%s: %s\r\n", key, val)
-		trailerData = append(trailerData, []byte(trailerLine)...)
+// Like write, with the io.Writer signature the chunked encoder needs.
+func (w *Writer) writeRaw(p []byte) (int, error) {
+	if err := w.write(p); err != nil {
+		return 0, err
 	}
-	trailerData = append(trailerData, []byte("\r\n")...)
+	return len(p), nil
+}
 
-	if w.httpWriter == nil {
-		w.Body = append(w.Body, trailerData...)
-		return nil
+// Writes to the buffer, remembering the first error so a broken connection is reported
+// to every later call.
+func (w *Writer) write(p []byte) error {
+	if w.err != nil {
+		return w.err
 	}
-
-	_, err := w.httpWriter.Write(trailerData)
-	return err
+	_, w.err = w.bw.Write(p)
+	return w.err
 }
@@ -0,0 +1,300 @@
+package response
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/boxy-pug/httpfromtcp/internal/headers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteHeaders(t *testing.T) {
+	// Test: Insertion order and canonical names
+	h := headers.NewHeaders()
+	h.Set("content-type", "text/plain")
+	h.Set("X-REQUEST-ID", "42")
+	h.Add("vary", "Accept")
+	h.Add("Vary", "Cookie")
+	h.Set("content-length", "2")
+
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	require.NoError(t, w.WriteStatusLine(OK))
+	require.NoError(t, w.WriteHeaders(h))
+	_, err := w.WriteBody([]byte("hi"))
+	require.NoError(t, err)
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n"+
+		"Content-Type: text/plain\r\n"+
+		"X-Request-Id: 42\r\n"+
+		"Vary: Accept\r\n"+
+		"Vary: Cookie\r\n"+
+		"Content-Length: 2\r\n"+
+		"\r\n"+
+		"hi", buf.String())
+	assert.True(t, w.KeepAlive())
+
+	// Test: Raw casing opt-out
+	buf.Reset()
+	w = NewWriter(&buf)
+	w.RawHeaderCase = true
+	w.WriteStatusLine(OK)
+	require.NoError(t, w.WriteHeaders(h))
+	w.Flush()
+	assert.Contains(t, buf.String(), "content-type: text/plain\r\nX-REQUEST-ID: 42\r\nvary: Accept\r\n")
+
+	// Test: CR/LF injection is refused and nothing is written
+	buf.Reset()
+	w = NewWriter(&buf)
+	w.WriteStatusLine(OK)
+	h = headers.NewHeaders()
+	h.Set("X-Evil", "1\r\nSet-Cookie: admin=1")
+	assert.Error(t, w.WriteHeaders(h))
+	h = headers.NewHeaders()
+	h.Set("Bad Name", "x")
+	assert.Error(t, w.WriteHeaders(h))
+	w.Flush()
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n", buf.String())
+
+	// Test: Content-Length must be digits and every copy must agree
+	for _, cls := range [][]string{{"+5"}, {"-0"}, {"0x5"}, {"5", "50"}} {
+		buf.Reset()
+		w = NewWriter(&buf)
+		w.WriteStatusLine(OK)
+		h = headers.NewHeaders()
+		for _, cl := range cls {
+			h.Add("Content-Length", cl)
+		}
+		assert.Error(t, w.WriteHeaders(h), cls)
+		w.Flush()
+		assert.Equal(t, "HTTP/1.1 200 OK\r\n", buf.String(), cls)
+	}
+	w = NewWriter(&buf)
+	w.WriteStatusLine(OK)
+	h = headers.NewHeaders()
+	h.Add("Content-Length", "5")
+	h.Add("Content-Length", "5")
+	assert.NoError(t, w.WriteHeaders(h))
+}
+
+func TestWriterOrder(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+
+	// Test: Nothing but the status line can come first
+	_, err := w.WriteBody([]byte("early"))
+	assert.ErrorIs(t, err, ErrWriteOrder)
+	assert.ErrorIs(t, w.WriteHeaders(headers.NewHeaders()), ErrWriteOrder)
+	assert.False(t, w.Written())
+
+	require.NoError(t, w.WriteStatusLine(OK))
+	assert.ErrorIs(t, w.WriteStatusLine(OK), ErrWriteOrder)
+	assert.True(t, w.Written())
+
+	require.NoError(t, w.WriteHeaders(GetDefaultHeaders(5)))
+	assert.ErrorIs(t, w.WriteHeaders(GetDefaultHeaders(5)), ErrWriteOrder)
+
+	// Test: Body can't outgrow Content-Length
+	_, err = w.WriteBody([]byte("hel"))
+	require.NoError(t, err)
+	_, err = w.WriteBody([]byte("lo!"))
+	assert.ErrorIs(t, err, ErrContentLength)
+
+	// Test: Nothing reaches the connection before a flush
+	assert.Equal(t, 0, buf.Len())
+
+	// Test: A short body can't be repaired, the connection has to go
+	require.NoError(t, w.Finish())
+	assert.False(t, w.KeepAlive())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nContent-Length: 5\r\nContent-Type: text/plain\r\n\r\nhel", buf.String())
+}
+
+func TestWriterFinish(t *testing.T) {
+	// Test: Handler wrote nothing at all
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nContent-Length: 0\r\nContent-Type: text/plain\r\n\r\n", buf.String())
+	assert.True(t, w.KeepAlive())
+
+	// Test: Body without framing closes the connection
+	buf.Reset()
+	w = NewWriter(&buf)
+	w.WriteStatusLine(OK)
+	w.WriteHeaders(headers.NewHeaders())
+	w.WriteBody([]byte("until EOF"))
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nConnection: close\r\n\r\nuntil EOF", buf.String())
+	assert.False(t, w.KeepAlive())
+
+	// Test: Refused headers become a 500 that closes the connection
+	buf.Reset()
+	w = NewWriter(&buf)
+	w.WriteStatusLine(OK)
+	h := headers.NewHeaders()
+	h.Set("Content-Length", "+5")
+	assert.Error(t, w.WriteHeaders(h))
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 500 Internal Server Error\r\nContent-Length: 0\r\nContent-Type: text/plain\r\nConnection: close\r\n\r\n", buf.String())
+	assert.False(t, w.KeepAlive())
+
+	// Test: Too late for a 500 once the status line was flushed, the connection still goes
+	buf.Reset()
+	w = NewWriter(&buf)
+	w.WriteStatusLine(OK)
+	w.Flush()
+	h.Set("Content-Length", "5\r\nX-Evil: 1")
+	assert.Error(t, w.WriteHeaders(h))
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nContent-Length: 0\r\nContent-Type: text/plain\r\nConnection: close\r\n\r\n", buf.String())
+	assert.False(t, w.KeepAlive())
+
+	// Test: Server asked to close before the headers
+	buf.Reset()
+	w = NewWriter(&buf)
+	w.CloseAfterResponse()
+	require.NoError(t, w.Finish())
+	assert.Contains(t, buf.String(), "Connection: close\r\n")
+	assert.False(t, w.KeepAlive())
+}
+
+func TestWriteStatusLine(t *testing.T) {
+	statusLine := func(code StatusCode) string {
+		var buf bytes.Buffer
+		w := NewWriter(&buf)
+		require.NoError(t, w.WriteStatusLine(code))
+		w.Flush()
+		return buf.String()
+	}
+
+	// Test: Registered codes get their reason phrase
+	assert.Equal(t, "HTTP/1.1 404 Not Found\r\n", statusLine(NotFound))
+	assert.Equal(t, "HTTP/1.1 301 Moved Permanently\r\n", statusLine(MovedPermanently))
+	assert.Equal(t, "HTTP/1.1 204 No Content\r\n", statusLine(NoContent))
+	assert.Equal(t, "HTTP/1.1 451 Unavailable For Legal Reasons\r\n", statusLine(UnavailableForLegalReasons))
+	assert.Equal(t, "Internal Server Error", StatusText(InternalError))
+
+	// Test: Unregistered codes keep an empty reason phrase
+	assert.Equal(t, "", StatusText(599))
+	assert.Equal(t, "HTTP/1.1 599 \r\n", statusLine(599))
+
+	// Test: Custom reason phrase
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	require.NoError(t, w.WriteStatusLineReason(OK, "Fine, Thanks"))
+	w.Flush()
+	assert.Equal(t, "HTTP/1.1 200 Fine, Thanks\r\n", buf.String())
+
+	// Test: Invalid codes and phrases write nothing
+	w = NewWriter(&buf)
+	assert.Error(t, w.WriteStatusLine(42))
+	assert.Error(t, w.WriteStatusLine(600))
+	assert.Error(t, w.WriteStatusLineReason(OK, "OK\r\nX-Evil: 1"))
+	assert.False(t, w.Written())
+}
+
+func TestWriterBodylessStatus(t *testing.T) {
+	// Test: 204 drops framing headers and refuses a body
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	w.WriteStatusLine(NoContent)
+	h := GetDefaultHeaders(5)
+	h.Set("Transfer-Encoding", "chunked")
+	require.NoError(t, w.WriteHeaders(h))
+	_, err := w.WriteBody([]byte("hello"))
+	assert.ErrorIs(t, err, ErrBodyNotAllowed)
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 204 No Content\r\nContent-Type: text/plain\r\n\r\n", buf.String())
+	assert.True(t, w.KeepAlive())
+
+	// Test: 304 keeps Content-Length of the representation but sends no body
+	buf.Reset()
+	w = NewWriter(&buf)
+	w.WriteStatusLine(NotModified)
+	h = headers.NewHeaders()
+	h.Set("ETag", `"v1"`)
+	h.Set("Content-Length", "1234")
+	require.NoError(t, w.WriteHeaders(h))
+	_, err = w.WriteBody([]byte("x"))
+	assert.ErrorIs(t, err, ErrBodyNotAllowed)
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 304 Not Modified\r\nEtag: \"v1\"\r\nContent-Length: 1234\r\n\r\n", buf.String())
+	assert.True(t, w.KeepAlive())
+
+	// Test: Finish after a bodyless status line adds no Content-Length
+	buf.Reset()
+	w = NewWriter(&buf)
+	w.WriteStatusLine(NoContent)
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 204 No Content\r\n\r\n", buf.String())
+
+	// Test: Interim responses are flushed and followed by the final response
+	buf.Reset()
+	w = NewWriter(&buf)
+	require.NoError(t, w.WriteStatusLine(EarlyHints))
+	h = headers.NewHeaders()
+	h.Set("Link", "</style.css>; rel=preload; as=style")
+	require.NoError(t, w.WriteHeaders(h))
+	assert.Equal(t, "HTTP/1.1 103 Early Hints\r\nLink: </style.css>; rel=preload; as=style\r\n\r\n", buf.String())
+	assert.False(t, w.Written())
+	w.WriteStatusLine(OK)
+	w.WriteHeaders(GetDefaultHeaders(2))
+	w.WriteBody([]byte("ok"))
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 103 Early Hints\r\nLink: </style.css>; rel=preload; as=style\r\n\r\n"+
+		"HTTP/1.1 200 OK\r\nContent-Length: 2\r\nContent-Type: text/plain\r\n\r\nok", buf.String())
+
+	// Test: Handler stopped after 100 Continue
+	buf.Reset()
+	w = NewWriter(&buf)
+	w.WriteStatusLine(Continue)
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 100 Continue\r\n\r\nHTTP/1.1 200 OK\r\nContent-Length: 0\r\nContent-Type: text/plain\r\n\r\n", buf.String())
+}
+
+func TestWriterOmitBody(t *testing.T) {
+	// Test: Headers go out as for GET, the body doesn't
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	w.OmitBody = true
+	w.WriteStatusLine(OK)
+	require.NoError(t, w.WriteHeaders(GetDefaultHeaders(5)))
+	n, err := w.WriteBody([]byte("hello"))
+	require.NoError(t, err)
+	assert.Equal(t, 5, n)
+	_, err = w.WriteBody([]byte("!"))
+	assert.ErrorIs(t, err, ErrContentLength)
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nContent-Length: 5\r\nContent-Type: text/plain\r\n\r\n", buf.String())
+	assert.True(t, w.KeepAlive())
+
+	// Test: Leaving out the body entirely keeps the connection open
+	buf.Reset()
+	w = NewWriter(&buf)
+	w.OmitBody = true
+	w.WriteStatusLine(OK)
+	require.NoError(t, w.WriteHeaders(GetDefaultHeaders(1234)))
+	require.NoError(t, w.Finish())
+	assert.True(t, w.KeepAlive())
+
+	// Test: Chunked body, last-chunk and trailers are dropped too
+	buf.Reset()
+	w = NewWriter(&buf)
+	w.OmitBody = true
+	w.WriteStatusLine(OK)
+	h := headers.NewHeaders()
+	h.Set("Transfer-Encoding", "chunked")
+	h.Set("Trailer", "X-Sum")
+	require.NoError(t, w.WriteHeaders(h))
+	_, err = w.WriteChunkedBody([]byte("hello"))
+	require.NoError(t, err)
+	_, err = w.WriteChunkedBodyDone()
+	require.NoError(t, err)
+	trailers := headers.NewHeaders()
+	trailers.Set("X-Sum", "1")
+	require.NoError(t, w.WriteTrailers(trailers))
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\nTrailer: X-Sum\r\n\r\n", buf.String())
+	assert.True(t, w.KeepAlive())
+}
@@ -0,0 +1,249 @@
+package router
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/boxy-pug/httpfromtcp/internal/headers"
+	"github.com/boxy-pug/httpfromtcp/internal/request"
+	"github.com/boxy-pug/httpfromtcp/internal/response"
+	"github.com/boxy-pug/httpfromtcp/internal/server"
+)
+
+// What to do with a request whose path only matches a route with or without a
+// trailing slash.
+type TrailingSlashPolicy int
+
+const (
+	// Redirect to the path of the route: 301 for GET and HEAD, 308 for other methods so
+	// the client repeats the request with the same method and body.
+	TrailingSlashRedirect TrailingSlashPolicy = iota
+	// Answer 404 like for any other unknown path.
+	TrailingSlashStrict
+)
+
+// Routes requests to handlers by method and path. Plug it into a server with
+// server.WithHandler(r.Serve), or with server.WithErrorHandler(r.ServeRequest) to have
+// errors answered by the server's ErrorRenderer and logged.
+//
+// Patterns are paths in which whole segments can be parameters: {name} matches one
+// non-empty segment and {name...} the rest of the path, including slashes, and can only
+// come last. Handlers read them with Request.PathValue. Static segments win over {name},
+// which wins over {name...}, whatever the order routes were added in. The request path is
+// split into segments at the slashes as sent, so an encoded slash (%2F) stays inside its
+// segment; each segment is percent-decoded before it is compared or becomes a value.
+//
+// A path with routes for other methods only gets 405 Method Not Allowed with an Allow
+// header. HEAD is served by the GET route unless it has its own, and OPTIONS is answered
+// with the Allow header unless it has a route.
+type Router struct {
+	*RouteGroup
+	TrailingSlash TrailingSlashPolicy
+
+	root    node
+	methods []string // Every method a route was added for, in order
+}
+
+// Adds routes below a common path prefix. Get one from Router.Group or RouteGroup.Group.
+type RouteGroup struct {
+	router *Router
+	prefix string
+}
+
+func New() *Router {
+	r := &Router{}
+	r.RouteGroup = &RouteGroup{router: r}
+	return r
+}
+
+// Returns a group whose routes all start with prefix, which is added to the group's own.
+// A trailing slash on prefix is ignored.
+func (g *RouteGroup) Group(prefix string) *RouteGroup {
+	return &RouteGroup{router: g.router, prefix: g.prefix + strings.TrimSuffix(prefix, "/")}
+}
+
+// Adds a route for method and pattern. Panics if the pattern is invalid, has a parameter
+// named differently from one at the same position in another route, or the route exists.
+func (g *RouteGroup) Handle(method, pattern string, h server.ErrorHandler) {
+	if !headers.ValidName(method) {
+		panic(fmt.Sprintf("router: invalid method %q", method))
+	}
+	if h == nil {
+		panic("router: nil handler for " + method + " " + pattern)
+	}
+	if err := g.router.root.insert(method, g.prefix+pattern, h); err != nil {
+		panic("router: " + err.Error())
+	}
+	if !slices.Contains(g.router.methods, method) {
+		g.router.methods = append(g.router.methods, method)
+	}
+}
+
+// Like Handle for a handler that writes its own error responses.
+func (g *RouteGroup) HandleFunc(method, pattern string, h server.Handler) {
+	g.Handle(method, pattern, func(w *response.Writer, req *request.Request) error {
+		h(w, req)
+		return nil
+	})
+}
+
+func (g *RouteGroup) Get(pattern string, h server.ErrorHandler) {
+	g.Handle("GET", pattern, h)
+}
+
+func (g *RouteGroup) Post(pattern string, h server.ErrorHandler) {
+	g.Handle("POST", pattern, h)
+}
+
+func (g *RouteGroup) Put(pattern string, h server.ErrorHandler) {
+	g.Handle("PUT", pattern, h)
+}
+
+func (g *RouteGroup) Patch(pattern string, h server.ErrorHandler) {
+	g.Handle("PATCH", pattern, h)
+}
+
+func (g *RouteGroup) Delete(pattern string, h server.ErrorHandler) {
+	g.Handle("DELETE", pattern, h)
+}
+
+// Serves req with the route matching its method and path. An unknown path returns a 404
+// HandlerError, a known path without a route for the method a 405 with an Allow header.
+// Has the server.ErrorHandler signature.
+func (r *Router) ServeRequest(w *response.Writer, req *request.Request) error {
+	if req.URL.Form == request.AsteriskForm && req.RequestLine.Method == "OPTIONS" {
+		// OPTIONS * asks about the server as a whole
+		return writeAllow(w, allowList(r.methods))
+	}
+	if req.URL.Path == "" {
+		return &server.HandlerError{StatusCode: response.NotFound}
+	}
+	path := routingPath(req.URL.RawPath)
+
+	if served, err := r.serve(w, req, path); served {
+		return err
+	}
+	if location, ok := r.slashRedirect(req); ok {
+		status := response.PermanentRedirect
+		if req.RequestLine.Method == "GET" || req.RequestLine.Method == "HEAD" {
+			status = response.MovedPermanently
+		}
+		w.WriteStatusLine(status)
+		h := response.GetDefaultHeaders(0)
+		h.Del("Content-Type")
+		h.Set("Location", location)
+		return w.WriteHeaders(h)
+	}
+	return &server.HandlerError{StatusCode: response.NotFound}
+}
+
+// Like ServeRequest with the server.Handler signature. Returned errors are answered with
+// server.RenderError unless the response was started already, errors other than
+// HandlerError with a 500.
+func (r *Router) Serve(w *response.Writer, req *request.Request) {
+	err := r.ServeRequest(w, req)
+	if err == nil || w.Written() {
+		return
+	}
+	var handlerErr *server.HandlerError
+	if !errors.As(err, &handlerErr) || handlerErr.StatusCode < 400 || handlerErr.StatusCode > 599 {
+		handlerErr = &server.HandlerError{StatusCode: response.InternalError}
+	}
+	rendered := *handlerErr
+	if rendered.Message == "" {
+		rendered.Message = response.StatusText(rendered.StatusCode)
+	}
+	server.RenderError(w, req, &rendered)
+}
+
+// Runs the route for req's method if one matches path, or answers OPTIONS and 405 for
+// a path with routes for other methods. Reports false if no route matches path at all.
+func (r *Router) serve(w *response.Writer, req *request.Request, path string) (bool, error) {
+	method := req.RequestLine.Method
+	var h server.ErrorHandler
+	r.root.lookup(path, nil, func(n *node, params []param) bool {
+		var ok bool
+		if h, ok = n.handlers[method]; !ok && method == "HEAD" {
+			h, ok = n.handlers["GET"]
+		}
+		if ok {
+			for _, p := range params {
+				req.SetPathValue(p.name, unescapeSegment(p.value))
+			}
+		}
+		return ok
+	})
+	if h != nil {
+		return true, h(w, req)
+	}
+
+	allowed := r.root.allowed(path)
+	if len(allowed) == 0 {
+		return false, nil
+	}
+	if method == "OPTIONS" {
+		return true, writeAllow(w, allowed)
+	}
+	return true, &server.HandlerError{StatusCode: response.MethodNotAllowed, Headers: allowHeader(allowed)}
+}
+
+// Returns where to redirect req if its path matches a route only once a trailing slash
+// is added or removed. The query is kept.
+func (r *Router) slashRedirect(req *request.Request) (string, bool) {
+	if r.TrailingSlash != TrailingSlashRedirect {
+		return "", false
+	}
+	rawPath := req.URL.RawPath
+	if rawPath == "/" {
+		return "", false
+	}
+	if strings.HasSuffix(rawPath, "/") {
+		rawPath = rawPath[:len(rawPath)-1]
+	} else {
+		rawPath += "/"
+	}
+	// "//host" would be taken as another host by the client
+	if strings.HasPrefix(rawPath, "//") || len(r.root.allowed(routingPath(rawPath))) == 0 {
+		return "", false
+	}
+	if req.URL.RawQuery != "" {
+		rawPath += "?" + req.URL.RawQuery
+	}
+	return rawPath, true
+}
+
+// Escapes the characters that would otherwise be mistaken for path syntax after decoding
+var segmentEscaper = strings.NewReplacer("%", "%25", "/", "%2F")
+
+// Undoes segmentEscaper
+var segmentUnescaper = strings.NewReplacer("%25", "%", "%2F", "/")
+
+// Returns the path routes are matched against: rawPath with every segment percent-decoded,
+// except that "%" and "/" stay encoded. Slashes in it are the ones the client sent as
+// separators and static text compares as decoded.
+func routingPath(rawPath string) string {
+	segments := strings.Split(rawPath, "/")
+	for i, seg := range segments {
+		// The parser already refused paths that don't decode
+		if decoded, err := url.PathUnescape(seg); err == nil {
+			segments[i] = segmentEscaper.Replace(decoded)
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+// Decodes a segment, or the rest of the path for a wildcard, of a routing path.
+func unescapeSegment(s string) string {
+	return segmentUnescaper.Replace(s)
+}
+
+// Answers an OPTIONS request with the allowed methods and no body.
+func writeAllow(w *response.Writer, methods []string) error {
+	if err := w.WriteStatusLine(response.NoContent); err != nil {
+		return err
+	}
+	return w.WriteHeaders(allowHeader(methods))
+}
@@ -0,0 +1,282 @@
+package router
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/boxy-pug/httpfromtcp/internal/request"
+	"github.com/boxy-pug/httpfromtcp/internal/response"
+	"github.com/boxy-pug/httpfromtcp/internal/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Returns a handler that answers with name followed by the given path parameters.
+func reply(name string, params ...string) server.ErrorHandler {
+	return func(w *response.Writer, req *request.Request) error {
+		body := name
+		for _, p := range params {
+			body += " " + p + "=" + req.PathValue(p)
+		}
+		w.WriteStatusLine(response.OK)
+		w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+		_, err := w.WriteBody([]byte(body))
+		return err
+	}
+}
+
+// Runs r for raw like the server would and returns the response and the handler's error.
+func serve(t *testing.T, r *Router, raw string) (string, error) {
+	t.Helper()
+	req, err := request.RequestFromReader(strings.NewReader(raw))
+	require.NoError(t, err)
+	var buf bytes.Buffer
+	w := response.NewWriter(&buf)
+	w.OmitBody = req.RequestLine.Method == "HEAD"
+	err = r.ServeRequest(w, req)
+	require.NoError(t, w.Finish())
+	return buf.String(), err
+}
+
+// Returns the body of a 200 response to a GET for path, or the status line otherwise.
+func get(t *testing.T, r *Router, path string) string {
+	t.Helper()
+	out, err := serve(t, r, "GET "+path+" HTTP/1.1\r\n\r\n")
+	var handlerErr *server.HandlerError
+	if err != nil {
+		require.ErrorAs(t, err, &handlerErr)
+		return response.StatusText(handlerErr.StatusCode)
+	}
+	status, _, _ := strings.Cut(out, "\r\n")
+	if status != "HTTP/1.1 200 OK" {
+		return status
+	}
+	_, body, _ := strings.Cut(out, "\r\n\r\n")
+	return body
+}
+
+func TestMatch(t *testing.T) {
+	r := New()
+	r.Get("/", reply("root"))
+	r.Get("/users", reply("users"))
+	r.Get("/users/new", reply("new user"))
+	r.Get("/users/{id}", reply("user", "id"))
+	r.Get("/users/{id}/posts/{post}", reply("post", "id", "post"))
+	r.Get("/useful", reply("useful"))
+	r.Get("/files/{path...}", reply("file", "path"))
+	r.Get("/files/readme", reply("readme"))
+	r.Get("/{page}", reply("page", "page"))
+
+	// Test: Static routes sharing prefixes
+	assert.Equal(t, "root", get(t, r, "/"))
+	assert.Equal(t, "users", get(t, r, "/users"))
+	assert.Equal(t, "useful", get(t, r, "/useful"))
+
+	// Test: Parameters match a whole segment, static segments win
+	assert.Equal(t, "user id=42", get(t, r, "/users/42"))
+	assert.Equal(t, "new user", get(t, r, "/users/new"))
+	assert.Equal(t, "user id=newer", get(t, r, "/users/newer"))
+	assert.Equal(t, "post id=7 post=hello", get(t, r, "/users/7/posts/hello"))
+	assert.Equal(t, "Not Found", get(t, r, "/users/7/posts"))
+	assert.Equal(t, "page page=about", get(t, r, "/about"))
+
+	// Test: Backtracking out of a static branch that ends without a route
+	assert.Equal(t, "page page=use", get(t, r, "/use"))
+
+	// Test: Wildcards take the rest, slashes included
+	assert.Equal(t, "file path=a/b/c.txt", get(t, r, "/files/a/b/c.txt"))
+	assert.Equal(t, "readme", get(t, r, "/files/readme"))
+	assert.Equal(t, "file path=", get(t, r, "/files/"))
+
+	// Test: Parameters are decoded
+	assert.Equal(t, "user id=jane doe", get(t, r, "/users/jane%20doe"))
+	assert.Equal(t, "user id=100%", get(t, r, "/users/100%25"))
+	assert.Equal(t, "users", get(t, r, "/user%73"))
+
+	// Test: An encoded slash stays inside its segment
+	assert.Equal(t, "user id=a/b", get(t, r, "/users/a%2Fb"))
+	assert.Equal(t, "user id=7/posts/hello", get(t, r, "/users/7%2Fposts%2Fhello"))
+	assert.Equal(t, "page page=users/new", get(t, r, "/users%2Fnew"))
+	assert.Equal(t, "file path=a/b/c", get(t, r, "/files/a%2Fb/c"))
+
+	// Test: Unknown paths
+	assert.Equal(t, "Not Found", get(t, r, "/users/7/comments"))
+	_, err := serve(t, r, "CONNECT example.com:443 HTTP/1.1\r\n\r\n")
+	assert.Equal(t, &server.HandlerError{StatusCode: response.NotFound}, err)
+}
+
+func TestMethods(t *testing.T) {
+	r := New()
+	r.Get("/items", reply("list"))
+	r.Post("/items", reply("create"))
+	r.Delete("/items/{id}", reply("delete", "id"))
+	r.Put("/items/special", reply("put special"))
+	r.Handle("OPTIONS", "/custom", reply("custom options"))
+	r.Handle("HEAD", "/custom", reply("custom head"))
+	r.Get("/custom", reply("custom get"))
+
+	// Test: Route by method
+	out, err := serve(t, r, "POST /items HTTP/1.1\r\nContent-Length: 0\r\n\r\n")
+	require.NoError(t, err)
+	assert.True(t, strings.HasSuffix(out, "\r\n\r\ncreate"))
+
+	// Test: 405 with the methods the path has
+	_, err = serve(t, r, "PATCH /items HTTP/1.1\r\n\r\n")
+	var handlerErr *server.HandlerError
+	require.ErrorAs(t, err, &handlerErr)
+	assert.Equal(t, response.MethodNotAllowed, handlerErr.StatusCode)
+	assert.Equal(t, "GET, HEAD, OPTIONS, POST", handlerErr.Headers.Get("Allow"))
+
+	// Test: Allow lists every route matching the path
+	_, err = serve(t, r, "GET /items/special HTTP/1.1\r\n\r\n")
+	require.ErrorAs(t, err, &handlerErr)
+	assert.Equal(t, "DELETE, OPTIONS, PUT", handlerErr.Headers.Get("Allow"))
+
+	// Test: A less specific route with the method wins over a 405
+	out, err = serve(t, r, "DELETE /items/special HTTP/1.1\r\n\r\n")
+	require.NoError(t, err)
+	assert.True(t, strings.HasSuffix(out, "\r\n\r\ndelete id=special"))
+
+	// Test: An encoded slash can't reach a route with more segments
+	r.Post("/items/{id}/purge", reply("purge", "id"))
+	_, err = serve(t, r, "POST /items/x%2Fpurge HTTP/1.1\r\nContent-Length: 0\r\n\r\n")
+	require.ErrorAs(t, err, &handlerErr)
+	assert.Equal(t, response.MethodNotAllowed, handlerErr.StatusCode)
+	out, err = serve(t, r, "DELETE /items/x%2Fpurge HTTP/1.1\r\n\r\n")
+	require.NoError(t, err)
+	assert.True(t, strings.HasSuffix(out, "\r\n\r\ndelete id=x/purge"))
+
+	// Test: Automatic OPTIONS
+	out, err = serve(t, r, "OPTIONS /items HTTP/1.1\r\n\r\n")
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 204 No Content\r\nAllow: GET, HEAD, OPTIONS, POST\r\n\r\n", out)
+	out, err = serve(t, r, "OPTIONS * HTTP/1.1\r\n\r\n")
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 204 No Content\r\nAllow: DELETE, GET, HEAD, OPTIONS, POST, PUT\r\n\r\n", out)
+
+	// Test: Automatic HEAD uses GET without sending the body
+	out, err = serve(t, r, "HEAD /items HTTP/1.1\r\n\r\n")
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nContent-Length: 4\r\nContent-Type: text/plain\r\n\r\n", out)
+
+	// Test: Routes of their own for OPTIONS and HEAD take over
+	out, err = serve(t, r, "OPTIONS /custom HTTP/1.1\r\n\r\n")
+	require.NoError(t, err)
+	assert.True(t, strings.HasSuffix(out, "\r\n\r\ncustom options"))
+	out, err = serve(t, r, "HEAD /custom HTTP/1.1\r\n\r\n")
+	require.NoError(t, err)
+	assert.Contains(t, out, "Content-Length: 11\r\n")
+}
+
+func TestServe(t *testing.T) {
+	r := New()
+	r.Get("/items", reply("list"))
+	r.Get("/fail", func(w *response.Writer, req *request.Request) error {
+		return errors.New("database is down")
+	})
+	var h server.Handler = r.Serve
+	run := func(raw string) string {
+		req, err := request.RequestFromReader(strings.NewReader(raw))
+		require.NoError(t, err)
+		var buf bytes.Buffer
+		w := response.NewWriter(&buf)
+		h(w, req)
+		require.NoError(t, w.Finish())
+		return buf.String()
+	}
+
+	// Test: Routes are served as with ServeRequest
+	assert.True(t, strings.HasSuffix(run("GET /items HTTP/1.1\r\n\r\n"), "\r\n\r\nlist"))
+
+	// Test: Returned errors are rendered
+	assert.Equal(t, "HTTP/1.1 404 Not Found\r\nContent-Length: 10\r\nContent-Type: text/plain\r\n\r\nNot Found\n", run("GET /nothing HTTP/1.1\r\n\r\n"))
+	out := run("POST /items HTTP/1.1\r\nContent-Length: 0\r\n\r\n")
+	assert.Contains(t, out, "HTTP/1.1 405 Method Not Allowed\r\n")
+	assert.Contains(t, out, "Allow: GET, HEAD, OPTIONS\r\n")
+
+	// Test: Other errors don't reach the client
+	out = run("GET /fail HTTP/1.1\r\n\r\n")
+	assert.Contains(t, out, "HTTP/1.1 500 Internal Server Error\r\n")
+	assert.NotContains(t, out, "database")
+}
+
+func TestTrailingSlash(t *testing.T) {
+	r := New()
+	r.Get("/docs/", reply("docs"))
+	r.Get("/about", reply("about"))
+	r.Post("/forms", reply("forms"))
+
+	// Test: GET is redirected permanently, the query is kept
+	out, err := serve(t, r, "GET /docs?page=2 HTTP/1.1\r\n\r\n")
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 301 Moved Permanently\r\nContent-Length: 0\r\nLocation: /docs/?page=2\r\n\r\n", out)
+	out, err = serve(t, r, "HEAD /about/ HTTP/1.1\r\n\r\n")
+	require.NoError(t, err)
+	assert.Contains(t, out, "HTTP/1.1 301 Moved Permanently\r\n")
+	assert.Contains(t, out, "Location: /about\r\n")
+
+	// Test: Other methods get 308 so the method and body are repeated
+	out, err = serve(t, r, "POST /forms/ HTTP/1.1\r\nContent-Length: 0\r\n\r\n")
+	require.NoError(t, err)
+	assert.Contains(t, out, "HTTP/1.1 308 Permanent Redirect\r\n")
+	assert.Contains(t, out, "Location: /forms\r\n")
+
+	// Test: Never to another host
+	r.Get("//evil.example", reply("evil"))
+	assert.Equal(t, "Not Found", get(t, r, "//evil.example/"))
+
+	// Test: Strict policy
+	r.TrailingSlash = TrailingSlashStrict
+	assert.Equal(t, "Not Found", get(t, r, "/docs"))
+	assert.Equal(t, "docs", get(t, r, "/docs/"))
+}
+
+func TestGroups(t *testing.T) {
+	r := New()
+	api := r.Group("/api/")
+	api.Get("/status", reply("status"))
+	v1 := api.Group("/v1")
+	v1.Get("/users/{id}", reply("v1 user", "id"))
+	v1.HandleFunc("GET", "/ping", func(w *response.Writer, req *request.Request) {
+		w.WriteStatusLine(response.OK)
+		w.WriteHeaders(response.GetDefaultHeaders(4))
+		w.WriteBody([]byte("pong"))
+	})
+
+	// Test: Prefixes add up
+	assert.Equal(t, "status", get(t, r, "/api/status"))
+	assert.Equal(t, "v1 user id=3", get(t, r, "/api/v1/users/3"))
+	assert.Equal(t, "pong", get(t, r, "/api/v1/ping"))
+	assert.Equal(t, "Not Found", get(t, r, "/v1/ping"))
+}
+
+func TestInvalidRoutes(t *testing.T) {
+	h := reply("x")
+	r := New()
+	r.Get("/users/{id}", h)
+	r.Get("/files/{path...}", h)
+
+	for _, pattern := range []string{
+		"users",             // Not a path
+		"/users/{id",        // Unclosed
+		"/users/id}",        // Unopened
+		"/users/x{id}",      // Not a whole segment
+		"/users/{id}x",      // Not a whole segment
+		"/users/{}",         // No name
+		"/users/{1st}",      // Not an identifier
+		"/a/{x}/{x}",        // Repeated name
+		"/a/{rest...}/more", // Wildcard not last
+		"/users/{name}",     // Conflicts with {id}
+		"/files/{rest...}",  // Conflicts with {path...}
+		"/users/{id}",       // Registered twice
+	} {
+		assert.Panics(t, func() { r.Get(pattern, h) }, pattern)
+	}
+	assert.Panics(t, func() { r.Handle("GE T", "/x", h) })
+	assert.Panics(t, func() { r.Get("/x", nil) })
+
+	// Test: Same pattern for another method is fine
+	assert.NotPanics(t, func() { r.Post("/users/{id}", h) })
+}
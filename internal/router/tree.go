@@ -0,0 +1,242 @@
+package router
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/boxy-pug/httpfromtcp/internal/headers"
+	"github.com/boxy-pug/httpfromtcp/internal/server"
+)
+
+// A node of the radix tree routes are stored in. Static text is shared between routes
+// down to the byte, parameters get children of their own. Lookups try static children
+// first, then a {name} parameter, then a {rest...} wildcard, and backtrack when a branch
+// ends without a match.
+type node struct {
+	prefix   string  // Static text this node matches, empty for parameter nodes
+	static   []*node // Children starting with static text, no two with the same first byte
+	param    *node   // Child matching one whole, non-empty path segment
+	wildcard *node   // Child matching the rest of the path, possibly empty
+	name     string  // Parameter name of a param or wildcard node
+
+	pattern  string                         // Pattern of the routes ending here
+	handlers map[string]server.ErrorHandler // Routes ending here by method, nil if there are none
+}
+
+// A path parameter picked up during a lookup
+type param struct {
+	name  string
+	value string
+}
+
+// One piece of a parsed pattern: static text, or a parameter when name is set
+type segment struct {
+	static   string
+	name     string
+	wildcard bool
+}
+
+// Splits a pattern into static text and parameters. Parameters must take up a whole path
+// segment and a wildcard must come last.
+func parsePattern(pattern string) ([]segment, error) {
+	if !strings.HasPrefix(pattern, "/") {
+		return nil, fmt.Errorf("pattern %q doesn't start with /", pattern)
+	}
+	var segments []segment
+	names := make(map[string]bool)
+	rest := pattern
+	for rest != "" {
+		open := strings.IndexByte(rest, '{')
+		if open < 0 {
+			if strings.ContainsRune(rest, '}') {
+				return nil, fmt.Errorf("pattern %q has an unmatched }", pattern)
+			}
+			segments = append(segments, segment{static: rest})
+			break
+		}
+		if open == 0 || rest[open-1] != '/' {
+			return nil, fmt.Errorf("parameter in pattern %q doesn't start a path segment", pattern)
+		}
+		if strings.ContainsRune(rest[:open], '}') {
+			return nil, fmt.Errorf("pattern %q has an unmatched }", pattern)
+		}
+		segments = append(segments, segment{static: rest[:open]})
+
+		end := strings.IndexByte(rest[open:], '}')
+		if end < 0 {
+			return nil, fmt.Errorf("pattern %q has an unmatched {", pattern)
+		}
+		end += open
+		name, wildcard := strings.CutSuffix(rest[open+1:end], "...")
+		if !validName(name) {
+			return nil, fmt.Errorf("invalid parameter name %q in pattern %q", name, pattern)
+		}
+		if names[name] {
+			return nil, fmt.Errorf("parameter %q appears twice in pattern %q", name, pattern)
+		}
+		names[name] = true
+		rest = rest[end+1:]
+		if rest != "" && (wildcard || rest[0] != '/') {
+			return nil, fmt.Errorf("parameter %q in pattern %q doesn't end its path segment or isn't last", name, pattern)
+		}
+		segments = append(segments, segment{name: name, wildcard: wildcard})
+	}
+	return segments, nil
+}
+
+// Parameter names are Go-style identifiers.
+func validName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i, ch := range name {
+		switch {
+		case ch == '_', 'a' <= ch && ch <= 'z', 'A' <= ch && ch <= 'Z':
+		case '0' <= ch && ch <= '9' && i > 0:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// Adds a route for method and returns an error if the pattern is invalid or the route
+// is already there. Parameters at the same position must have the same name.
+func (n *node) insert(method, pattern string, h server.ErrorHandler) error {
+	segments, err := parsePattern(pattern)
+	if err != nil {
+		return err
+	}
+	for _, seg := range segments {
+		switch {
+		case seg.name == "":
+			// Compared with routing paths, where a literal % is encoded
+			n = n.insertStatic(strings.ReplaceAll(seg.static, "%", "%25"))
+		case seg.wildcard:
+			if n.wildcard == nil {
+				n.wildcard = &node{name: seg.name}
+			} else if n.wildcard.name != seg.name {
+				return fmt.Errorf("wildcard {%s...} in pattern %q conflicts with {%s...} of %q", seg.name, pattern, n.wildcard.name, n.wildcard.pattern)
+			}
+			n = n.wildcard
+		default:
+			if n.param == nil {
+				n.param = &node{name: seg.name}
+			} else if n.param.name != seg.name {
+				return fmt.Errorf("parameter {%s} in pattern %q conflicts with {%s} registered before", seg.name, pattern, n.param.name)
+			}
+			n = n.param
+		}
+	}
+	if _, ok := n.handlers[method]; ok {
+		return fmt.Errorf("route %s %s registered twice", method, pattern)
+	}
+	if n.handlers == nil {
+		n.handlers = make(map[string]server.ErrorHandler)
+	}
+	n.handlers[method] = h
+	n.pattern = pattern
+	return nil
+}
+
+// Walks down static children matching s, splitting nodes where s leaves their prefix,
+// and returns the node that ends at the end of s.
+func (n *node) insertStatic(s string) *node {
+	for s != "" {
+		child := n.staticChild(s[0])
+		if child == nil {
+			child = &node{prefix: s}
+			n.static = append(n.static, child)
+			return child
+		}
+		common := commonPrefix(child.prefix, s)
+		if common < len(child.prefix) {
+			// Move the child's own content one level down, below the shared part
+			rest := *child
+			rest.prefix = child.prefix[common:]
+			*child = node{prefix: child.prefix[:common], static: []*node{&rest}}
+		}
+		n, s = child, s[common:]
+	}
+	return n
+}
+
+func (n *node) staticChild(first byte) *node {
+	for _, child := range n.static {
+		if child.prefix[0] == first {
+			return child
+		}
+	}
+	return nil
+}
+
+func commonPrefix(a, b string) int {
+	i := 0
+	for i < len(a) && i < len(b) && a[i] == b[i] {
+		i++
+	}
+	return i
+}
+
+// Finds the nodes routes for path end at, given that n has matched everything before it,
+// and calls visit for each with the parameters picked up on the way, most specific first.
+// Stops and returns true as soon as visit does.
+func (n *node) lookup(path string, params []param, visit func(n *node, params []param) bool) bool {
+	if path == "" {
+		if n.handlers != nil && visit(n, params) {
+			return true
+		}
+	} else if child := n.staticChild(path[0]); child != nil && strings.HasPrefix(path, child.prefix) {
+		if child.lookup(path[len(child.prefix):], params, visit) {
+			return true
+		}
+	}
+	if n.param != nil && path != "" {
+		end := strings.IndexByte(path, '/')
+		if end < 0 {
+			end = len(path)
+		}
+		if end > 0 && n.param.lookup(path[end:], append(params, param{n.param.name, path[:end]}), visit) {
+			return true
+		}
+	}
+	if n.wildcard != nil {
+		return visit(n.wildcard, append(params, param{n.wildcard.name, path}))
+	}
+	return false
+}
+
+// Returns the methods of all routes whose pattern matches path, as for an Allow header.
+func (n *node) allowed(path string) []string {
+	var methods []string
+	n.lookup(path, nil, func(n *node, _ []param) bool {
+		for method := range n.handlers {
+			methods = append(methods, method)
+		}
+		return false
+	})
+	return allowList(methods)
+}
+
+// Sorts methods and adds the ones the router answers without a route: HEAD along with
+// GET, and OPTIONS along with anything. Returns nil for no methods.
+func allowList(methods []string) []string {
+	if len(methods) == 0 {
+		return nil
+	}
+	methods = append([]string(nil), methods...)
+	if slices.Contains(methods, "GET") {
+		methods = append(methods, "HEAD")
+	}
+	methods = append(methods, "OPTIONS")
+	slices.Sort(methods)
+	return slices.Compact(methods)
+}
+
+// Builds the headers of a response listing methods in Allow.
+func allowHeader(methods []string) *headers.Headers {
+	h := headers.NewHeaders()
+	h.Set("Allow", strings.Join(methods, ", "))
+	return h
+}
@@ -0,0 +1,197 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// First file descriptor passed by systemd-style socket activation, after stdin, stdout and stderr
+const listenFDsStart = 3
+
+const (
+	envListenFDs     = "LISTEN_FDS"
+	envListenPID     = "LISTEN_PID"
+	envListenFDNames = "LISTEN_FDNAMES"
+
+	// Set by Upgrade instead of LISTEN_PID, which can't be known before the new process starts
+	envUpgradeParent = "HTTPFROMTCP_UPGRADE_PPID"
+	// Descriptor of the pipe NotifyReady reports readiness on
+	envUpgradeReady = "HTTPFROMTCP_UPGRADE_READY_FD"
+)
+
+// Returns the listening sockets passed to this process by systemd socket activation
+// (LISTEN_FDS and LISTEN_PID) or by Upgrade in the parent process. Returns none if nothing
+// was passed. The variables are removed from the environment so they don't leak into
+// processes started later.
+func InheritedListeners() ([]net.Listener, error) {
+	pid := os.Getenv(envListenPID)
+	parent := os.Getenv(envUpgradeParent)
+	count := os.Getenv(envListenFDs)
+	names := strings.Split(os.Getenv(envListenFDNames), ":")
+	os.Unsetenv(envListenPID)
+	os.Unsetenv(envUpgradeParent)
+	os.Unsetenv(envListenFDs)
+	os.Unsetenv(envListenFDNames)
+
+	// The variables are meant for a specific process, not for whatever it starts
+	if pid != strconv.Itoa(os.Getpid()) && parent != strconv.Itoa(os.Getppid()) {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(count)
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("server: invalid %s %q", envListenFDs, count)
+	}
+
+	listeners := make([]net.Listener, 0, n)
+	for i := 0; i < n; i++ {
+		name := fmt.Sprintf("listen-fd-%d", listenFDsStart+i)
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		// FileListener works on a duplicate, the inherited descriptor itself isn't needed after
+		f := os.NewFile(uintptr(listenFDsStart+i), name)
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, fmt.Errorf("server: inherited listener %s: %w", name, err)
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
+
+// Tells the process that started this one with Upgrade that it is serving, so the old one
+// can shut down. Call it once the server accepts connections. Does nothing if the process
+// wasn't started by Upgrade.
+func NotifyReady() error {
+	fd := os.Getenv(envUpgradeReady)
+	if fd == "" {
+		return nil
+	}
+	os.Unsetenv(envUpgradeReady)
+
+	n, err := strconv.Atoi(fd)
+	if err != nil {
+		return fmt.Errorf("server: invalid %s %q", envUpgradeReady, fd)
+	}
+	f := os.NewFile(uintptr(n), "upgrade-ready")
+	defer f.Close()
+	_, err = f.Write([]byte{1})
+	return err
+}
+
+// Starts a new copy of the running executable with the same arguments, handing it the
+// listener, and waits until it calls NotifyReady. From then on both processes accept
+// connections on the same socket, call Shutdown to leave them to the new one. If the new
+// process exits or isn't ready before ctx is done it is killed and the server carries on
+// as before.
+func (s *Server) Upgrade(ctx context.Context) error {
+	fl, ok := s.Listener.(interface{ File() (*os.File, error) })
+	if !ok {
+		return errors.New("server: listener can't be handed over")
+	}
+	lf, err := fl.File()
+	if err != nil {
+		return err
+	}
+	defer lf.Close()
+
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer readyR.Close()
+
+	// os/exec would put the descriptors in blocking mode, which is shared with our listener
+	// and would leave its Accept stuck in the kernel where Close can't interrupt it
+	lfd, err := rawFD(lf)
+	if err != nil {
+		readyW.Close()
+		return err
+	}
+	wfd, err := rawFD(readyW)
+	if err != nil {
+		readyW.Close()
+		return err
+	}
+	env := append(upgradeEnviron(),
+		envListenFDs+"=1",
+		envUpgradeParent+"="+strconv.Itoa(os.Getpid()),
+		envUpgradeReady+"="+strconv.Itoa(listenFDsStart+1),
+	)
+	// Descriptors from 3 on: the listener, then the readiness pipe
+	files := []uintptr{os.Stdin.Fd(), os.Stdout.Fd(), os.Stderr.Fd(), lfd, wfd}
+	pid, err := syscall.ForkExec(exe, os.Args, &syscall.ProcAttr{Env: env, Files: files})
+	// Only the child may hold the write end, or its exit wouldn't end our read
+	readyW.Close()
+	if err != nil {
+		return err
+	}
+	proc, err := os.FindProcess(pid)
+	if err != nil {
+		return err
+	}
+
+	ready := make(chan error, 1)
+	go func() {
+		_, err := readyR.Read(make([]byte, 1))
+		ready <- err
+	}()
+	select {
+	case err = <-ready:
+		if err != nil {
+			err = fmt.Errorf("server: new process exited before it was ready: %w", err)
+		}
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	if err != nil {
+		proc.Kill()
+		proc.Wait()
+		return err
+	}
+
+	// The socket file now belongs to the new process as well, closing ours must not remove it
+	if ul, ok := s.Listener.(*net.UnixListener); ok {
+		ul.SetUnlinkOnClose(false)
+	}
+	return proc.Release()
+}
+
+// Returns the descriptor of f without the switch to blocking mode f.Fd makes.
+func rawFD(f *os.File) (uintptr, error) {
+	rc, err := f.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	var fd uintptr
+	err = rc.Control(func(p uintptr) { fd = p })
+	return fd, err
+}
+
+// The current environment minus any activation variables we were started with
+func upgradeEnviron() []string {
+	var env []string
+	for _, kv := range os.Environ() {
+		key, _, _ := strings.Cut(kv, "=")
+		switch key {
+		case envListenFDs, envListenPID, envListenFDNames, envUpgradeParent, envUpgradeReady:
+			continue
+		}
+		env = append(env, kv)
+	}
+	return env
+}
@@ -0,0 +1,136 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// Reported by context.Cause on a request's context once the client has gone away.
+var ErrClientDisconnected = errors.New("server: client disconnected")
+
+// A deadline in the past, used to interrupt a pending read.
+var aLongTimeAgo = time.Unix(1, 0)
+
+// Reads from a connection for the parser. Notices when the first byte of a request arrives:
+// from then on the connection counts as active for Shutdown and the header timeout runs.
+//
+// While the handler runs after the whole request was read, a background read watches the
+// connection so the request's context can be cancelled if the client goes away. A byte
+// it picks up instead (the start of a pipelined request) is handed to the parser later.
+type connReader struct {
+	s           *Server
+	conn        net.Conn
+	start       time.Time // When the current request started arriving, zero while waiting for it
+	headersDone time.Time // When the header section of the current request was complete
+
+	cancel context.CancelCauseFunc // Cancels the context of the request being served
+
+	bgDone   chan struct{} // Closed when the background read returns, nil if none is running
+	mu       sync.Mutex
+	aborting bool // The background read is being interrupted on purpose, guarded by mu
+	hasByte  bool // byteBuf holds a byte read in the background
+	byteBuf  byte
+	byteTime time.Time // When byteBuf arrived
+	bgErr    error     // Error from the background read, returned by the next Read
+}
+
+func (r *connReader) Read(p []byte) (int, error) {
+	if r.hasByte && len(p) > 0 {
+		p[0] = r.byteBuf
+		r.hasByte = false
+		if r.start.IsZero() {
+			r.startRequest(r.byteTime)
+		}
+		return 1, nil
+	}
+	if r.bgErr != nil {
+		err := r.bgErr
+		r.bgErr = nil
+		return 0, err
+	}
+
+	n, err := r.conn.Read(p)
+	if n > 0 && r.start.IsZero() {
+		r.startRequest(time.Now())
+	}
+	return n, err
+}
+
+// Prepares for the next request and sets how long the connection may wait for it.
+func (r *connReader) waitRequest() {
+	r.start = time.Time{}
+	r.headersDone = time.Time{}
+	r.s.setConnState(r.conn, connStateIdle)
+	r.conn.SetReadDeadline(time.Now().Add(r.s.idleTimeout()))
+}
+
+func (r *connReader) startRequest(now time.Time) {
+	r.start = now
+	r.headersDone = time.Time{}
+	r.s.setConnState(r.conn, connStateActive)
+	r.conn.SetReadDeadline(deadline(now, r.s.readHeaderTimeout()))
+}
+
+// Starts reading a single byte in the background. Reading fails once the client closes
+// or resets the connection, which cancels the current request's context. The request has
+// been read completely, so the read timeouts no longer apply.
+func (r *connReader) startBackgroundRead() {
+	if r.bgDone != nil || r.hasByte || r.bgErr != nil {
+		return
+	}
+	r.conn.SetReadDeadline(time.Time{})
+	done := make(chan struct{})
+	r.bgDone = done
+	cancel := r.cancel
+	go func() {
+		defer close(done)
+		var buf [1]byte
+		n, err := r.conn.Read(buf[:])
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if n > 0 {
+			r.hasByte, r.byteBuf, r.byteTime = true, buf[0], time.Now()
+			return
+		}
+		if r.aborting {
+			// Interrupted by abortBackgroundRead, the connection is fine
+			return
+		}
+		r.bgErr = err
+		if cancel != nil {
+			cancel(ErrClientDisconnected)
+		}
+	}()
+}
+
+// Stops the background read, if any, and waits for it. Must be called before the parser
+// reads again; the caller sets a new read deadline afterwards.
+func (r *connReader) abortBackgroundRead() {
+	if r.bgDone == nil {
+		return
+	}
+	r.mu.Lock()
+	r.aborting = true
+	r.mu.Unlock()
+	r.conn.SetReadDeadline(aLongTimeAgo)
+	<-r.bgDone
+
+	r.bgDone = nil
+	r.aborting = false
+}
+
+// Reports whether the start of the next request was already read in the background.
+func (r *connReader) pending() bool {
+	return r.hasByte
+}
+
+// Returns the time d after start, or the zero time (no deadline) if d isn't positive.
+func deadline(start time.Time, d time.Duration) time.Time {
+	if d <= 0 {
+		return time.Time{}
+	}
+	return start.Add(d)
+}
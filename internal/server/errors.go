@@ -0,0 +1,169 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"strconv"
+	"strings"
+
+	"github.com/boxy-pug/httpfromtcp/internal/headers"
+	"github.com/boxy-pug/httpfromtcp/internal/request"
+	"github.com/boxy-pug/httpfromtcp/internal/response"
+)
+
+// A handler that reports failure by returning an error instead of writing the error
+// response itself. Return a *HandlerError to choose the status code and message, any other
+// error becomes a 500 whose details are only logged.
+type ErrorHandler func(w *response.Writer, req *request.Request) error
+
+// Writes the response for a failed ErrorHandler. err always has a status code and message.
+type ErrorRenderer func(w *response.Writer, req *request.Request, err *HandlerError)
+
+func (e *HandlerError) Error() string {
+	return fmt.Sprintf("%d %s", e.StatusCode, e.Message)
+}
+
+// Media types RenderError can produce, in order of preference when the client rates them equally
+var errorMediaTypes = []string{"text/plain", "text/html", "application/problem+json", "application/json"}
+
+// The default ErrorRenderer. Picks plain text, HTML or JSON problem details (RFC 9457)
+// based on the request's Accept header.
+func RenderError(w *response.Writer, req *request.Request, err *HandlerError) {
+	accept := strings.Join(req.Headers.Values("Accept"), ",")
+	switch negotiate(accept, errorMediaTypes) {
+	case "text/html":
+		RenderErrorHTML(w, req, err)
+	case "application/problem+json", "application/json":
+		RenderErrorJSON(w, req, err)
+	default:
+		RenderErrorText(w, req, err)
+	}
+}
+
+func RenderErrorText(w *response.Writer, req *request.Request, err *HandlerError) {
+	writeError(w, err, "text/plain", []byte(err.Message+"\n"))
+}
+
+func RenderErrorHTML(w *response.Writer, req *request.Request, err *HandlerError) {
+	title := fmt.Sprintf("%d %s", err.StatusCode, response.StatusText(err.StatusCode))
+	body := `<html>
+  <head>
+    <title>` + html.EscapeString(title) + `</title>
+  </head>
+  <body>
+    <h1>` + html.EscapeString(response.StatusText(err.StatusCode)) + `</h1>
+    <p>` + html.EscapeString(err.Message) + `</p>
+  </body>
+</html>`
+	writeError(w, err, "text/html", []byte(body))
+}
+
+func RenderErrorJSON(w *response.Writer, req *request.Request, err *HandlerError) {
+	problem := struct {
+		Type     string `json:"type"`
+		Title    string `json:"title,omitempty"`
+		Status   int    `json:"status"`
+		Detail   string `json:"detail,omitempty"`
+		Instance string `json:"instance,omitempty"`
+	}{
+		Type:   "about:blank",
+		Title:  response.StatusText(err.StatusCode),
+		Status: int(err.StatusCode),
+		Detail: err.Message,
+	}
+	if req.URL != nil {
+		problem.Instance = req.URL.Path
+	}
+	body, _ := json.Marshal(problem)
+	writeError(w, err, "application/problem+json", body)
+}
+
+func writeError(w *response.Writer, err *HandlerError, contentType string, body []byte) {
+	w.WriteStatusLine(err.StatusCode)
+	h := headers.NewHeaders()
+	err.Headers.Range(func(key, val string) bool {
+		switch strings.ToLower(key) {
+		case "content-length", "content-type", "transfer-encoding":
+		default:
+			h.Add(key, val)
+		}
+		return true
+	})
+	h.Set("Content-Length", strconv.Itoa(len(body)))
+	h.Set("Content-Type", contentType)
+	w.WriteHeaders(h)
+	w.WriteBody(body)
+}
+
+// Turns the error returned by an ErrorHandler into a response. Errors other than
+// HandlerError are logged and hidden from the client behind a plain 500.
+func (s *Server) handleError(w *response.Writer, req *request.Request, err error) {
+	var handlerErr *HandlerError
+	if !errors.As(err, &handlerErr) {
+		s.logf("Error handling %s %s: %v", req.RequestLine.Method, req.RequestLine.RequestTarget, err)
+		handlerErr = &HandlerError{StatusCode: response.InternalError}
+	}
+	if w.Written() {
+		// Too late for an error page, the client gets whatever the handler wrote
+		s.logf("Error after response was started for %s %s: %v", req.RequestLine.Method, req.RequestLine.RequestTarget, err)
+		return
+	}
+
+	rendered := *handlerErr
+	if rendered.StatusCode < 400 || rendered.StatusCode > 599 {
+		rendered.StatusCode = response.InternalError
+	}
+	if rendered.Message == "" {
+		rendered.Message = response.StatusText(rendered.StatusCode)
+	}
+	render := s.ErrorRenderer
+	if render == nil {
+		render = RenderError
+	}
+	render(w, req, &rendered)
+}
+
+// Returns the offer the Accept header rates highest, or "" if it accepts none of them.
+// An empty Accept header accepts anything, so the first offer wins.
+func negotiate(accept string, offers []string) string {
+	if strings.TrimSpace(accept) == "" {
+		return offers[0]
+	}
+	best, bestQ, bestSpecificity := "", 0.0, -1
+	for _, offer := range offers {
+		offerType, _, _ := strings.Cut(offer, "/")
+		// The most specific matching range decides the quality of an offer
+		q, specificity := 0.0, -1
+		for _, mediaRange := range strings.Split(accept, ",") {
+			params := strings.Split(mediaRange, ";")
+			rangeType := strings.ToLower(strings.TrimSpace(params[0]))
+			s := -1
+			switch {
+			case rangeType == offer:
+				s = 2
+			case rangeType == offerType+"/*":
+				s = 1
+			case rangeType == "*/*":
+				s = 0
+			}
+			if s <= specificity {
+				continue
+			}
+			specificity, q = s, 1
+			for _, param := range params[1:] {
+				key, val, _ := strings.Cut(strings.TrimSpace(param), "=")
+				if strings.EqualFold(key, "q") {
+					if v, err := strconv.ParseFloat(val, 64); err == nil && v >= 0 && v <= 1 {
+						q = v
+					}
+				}
+			}
+		}
+		if q > bestQ || (q == bestQ && q > 0 && specificity > bestSpecificity) {
+			best, bestQ, bestSpecificity = offer, q, specificity
+		}
+	}
+	return best
+}
@@ -0,0 +1,100 @@
+package server
+
+import (
+	"crypto/tls"
+	"log"
+	"os"
+	"time"
+
+	"github.com/boxy-pug/httpfromtcp/internal/request"
+)
+
+// Configures a Server built with New. Each option sets the Server field of the same name.
+type Option func(s *Server)
+
+// Builds a Server from options. Call Listen or ServeListener to start it.
+func New(opts ...Option) *Server {
+	s := &Server{}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// Address to listen on: host:port for TCP, e.g. "127.0.0.1:8080", "[::1]:8080" or ":8080"
+// for every interface, or a socket path for unix. A path starting with "@" is a Linux
+// abstract socket.
+func WithAddr(addr string) Option {
+	return func(s *Server) { s.Addr = addr }
+}
+
+// One of tcp, tcp4, tcp6 or unix.
+func WithNetwork(network string) Option {
+	return func(s *Server) { s.Network = network }
+}
+
+// Permissions of the socket file when listening on a Unix socket path.
+func WithUnixSocketMode(mode os.FileMode) Option {
+	return func(s *Server) { s.UnixSocketMode = mode }
+}
+
+// Owner and group of the socket file when listening on a Unix socket path, as names or
+// numeric IDs. Either may be empty to leave it unchanged.
+func WithUnixSocketOwner(owner, group string) Option {
+	return func(s *Server) {
+		s.UnixSocketOwner = owner
+		s.UnixSocketGroup = group
+	}
+}
+
+func WithTLSConfig(config *tls.Config) Option {
+	return func(s *Server) { s.TLSConfig = config }
+}
+
+func WithHandler(h Handler) Option {
+	return func(s *Server) { s.Handler = h }
+}
+
+func WithErrorHandler(h ErrorHandler) Option {
+	return func(s *Server) { s.ErrorHandler = h }
+}
+
+func WithErrorRenderer(r ErrorRenderer) Option {
+	return func(s *Server) { s.ErrorRenderer = r }
+}
+
+func WithPanicHook(hook func(req *request.Request, recovered any, stack []byte)) Option {
+	return func(s *Server) { s.PanicHook = hook }
+}
+
+func WithLimits(limits request.Limits) Option {
+	return func(s *Server) { s.Limits = limits }
+}
+
+func WithMaxRequestsPerConn(n int) Option {
+	return func(s *Server) { s.MaxRequestsPerConn = n }
+}
+
+func WithStreamRequestBody(stream bool) Option {
+	return func(s *Server) { s.StreamRequestBody = stream }
+}
+
+func WithIdleTimeout(d time.Duration) Option {
+	return func(s *Server) { s.IdleTimeout = d }
+}
+
+func WithReadHeaderTimeout(d time.Duration) Option {
+	return func(s *Server) { s.ReadHeaderTimeout = d }
+}
+
+func WithReadTimeout(d time.Duration) Option {
+	return func(s *Server) { s.ReadTimeout = d }
+}
+
+func WithWriteTimeout(d time.Duration) Option {
+	return func(s *Server) { s.WriteTimeout = d }
+}
+
+func WithLogger(logger *log.Logger) Option {
+	return func(s *Server) { s.Logger = logger }
+}
@@ -1,95 +1,507 @@
 package server
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
+	"os"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/boxy-pug/httpfromtcp/internal/headers"
 	"github.com/boxy-pug/httpfromtcp/internal/request"
 	"github.com/boxy-pug/httpfromtcp/internal/response"
 )
 
+const (
+	DefaultNetwork            = "tcp"
+	DefaultAddr               = "127.0.0.1:42069"
+	DefaultMaxRequestsPerConn = 100
+	DefaultIdleTimeout        = 30 * time.Second
+)
+
 // Contains the state of the server
 type Server struct {
-	State    bool
+	// Network and address Listen binds to, as accepted by net.Listen.
+	// Empty means DefaultNetwork and DefaultAddr.
+	Network string
+	Addr    string
+	// Permissions and owner of the socket file when listening on a Unix socket path.
+	// Zero and empty leave what the process creates by default. Owner and group are names
+	// or numeric IDs.
+	UnixSocketMode  os.FileMode
+	UnixSocketOwner string
+	UnixSocketGroup string
+
 	Listener net.Listener
-	Handler  Handler
+	// Serve HTTPS with this configuration, e.g. from CertStore.TLSConfig. The handshake must
+	// finish within ReadHeaderTimeout, or IdleTimeout if neither it nor ReadTimeout is set.
+	// For mutual TLS set ClientCAs and ClientAuth, handlers find the client's certificate in
+	// Request.TLS.
+	TLSConfig *tls.Config
+
+	Handler Handler
+	// Used instead of Handler if set. Returned errors are answered through ErrorRenderer.
+	ErrorHandler ErrorHandler
+	// Writes the error response for a failed ErrorHandler. Nil means RenderError.
+	ErrorRenderer ErrorRenderer
+	// Called after a handler panic has been logged, e.g. to report it elsewhere. Not called
+	// for ErrAbortHandler.
+	PanicHook func(req *request.Request, recovered any, stack []byte)
+
+	// Maximum number of requests served on one connection before it is closed.
+	// Zero means DefaultMaxRequestsPerConn.
+	MaxRequestsPerConn int
+	// How long a connection may wait for the first byte of its next request.
+	// Zero means DefaultIdleTimeout.
+	IdleTimeout time.Duration
+	// How long reading the request line and headers may take, counted from the first
+	// byte of the request. Zero means ReadTimeout applies, if that is zero too there is no limit.
+	ReadHeaderTimeout time.Duration
+	// How long reading the whole request including the body may take, counted from its
+	// first byte. With StreamRequestBody this covers the handler reading the body. Zero means no limit.
+	ReadTimeout time.Duration
+	// How long writing the response may take, counted from the end of the request headers,
+	// so a body that is slow to arrive uses it up too. Zero means no limit.
+	WriteTimeout time.Duration
+	// Hand request bodies to the handler as a stream through Request.BodyReader
+	// instead of reading them into Request.Body before the handler runs.
+	StreamRequestBody bool
+	// Size limits for incoming requests. Zero fields fall back to request.DefaultLimits.
+	Limits request.Limits
+	// Where errors and panics are logged. Nil means the standard logger.
+	Logger *log.Logger
+
+	closed     atomic.Bool   // Set by Close and Shutdown
+	nextConnID atomic.Uint64 // Last connection ID handed out
+	listenDone chan struct{} // Closed when the accept loop returns
+
+	baseOnce   sync.Once
+	baseCtx    context.Context         // Parent of every request context
+	cancelBase context.CancelCauseFunc // Cancels baseCtx once requests are cut off
+
+	mu    sync.Mutex
+	conns map[net.Conn]connState // Open connections, guarded by mu
 }
 
+// An error an ErrorHandler can return to have the server answer with StatusCode and
+// Message. Codes outside 4xx and 5xx become 500; an empty Message the status text.
 type HandlerError struct {
 	Message    string
 	StatusCode response.StatusCode
+	// Extra fields for the error response, e.g. Allow with a 405. The renderer sets
+	// the framing and Content-Type itself.
+	Headers *headers.Headers
 }
 
 type Handler func(w *response.Writer, req *request.Request)
 
+// A handler can panic with ErrAbortHandler to drop the connection without a response and
+// without the panic being logged.
+var ErrAbortHandler = errors.New("server: abort handler")
+
+// Reported by context.Cause on the context of requests cut off by Close or by Shutdown
+// giving up on them.
+var ErrServerClosed = errors.New("server: closed")
+
 // Creates a net.Listener and returns a new Server instance. Starts listening for requests inside a goroutine.
 func Serve(port int, h Handler) (*Server, error) {
+	s := &Server{Handler: h}
+	if err := s.Start(port); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
 
-	s := &Server{}
+// Like Serve, but uses the configuration already set on s. Always listens on TCP port of
+// the loopback interface, use Listen for anything else. Fields must not be changed after Start.
+func (s *Server) Start(port int) error {
+	s.Network = "tcp"
+	s.Addr = fmt.Sprintf("127.0.0.1:%d", port)
+	return s.Listen()
+}
 
-	portString := fmt.Sprintf("127.0.0.1:%d", port)
+// Creates a listener for Network and Addr and starts accepting connections on it inside
+// a goroutine. Fields must not be changed after Listen.
+func (s *Server) Listen() error {
+	network, addr := s.Network, s.Addr
+	if network == "" {
+		network = DefaultNetwork
+	}
+	if addr == "" {
+		addr = DefaultAddr
+	}
 
-	l, err := net.Listen("tcp", portString)
+	var l net.Listener
+	var err error
+	if network == "unix" {
+		l, err = s.listenUnix(addr)
+	} else {
+		l, err = net.Listen(network, addr)
+	}
 	if err != nil {
-		return nil, err
+		return err
+	}
+	if err := s.ServeListener(l); err != nil {
+		l.Close()
+		return err
+	}
+	return nil
+}
+
+// Starts accepting connections on a listener created by the caller inside a goroutine.
+// The server takes ownership of l and closes it on Close or Shutdown.
+func (s *Server) ServeListener(l net.Listener) error {
+	if s.Handler == nil && s.ErrorHandler == nil {
+		return errors.New("server: no handler")
+	}
+	if s.Listener != nil {
+		return errors.New("server: already started")
 	}
 
 	s.Listener = l
-	s.State = true
-	s.Handler = h
+	s.listenDone = make(chan struct{})
 
 	go s.listen()
 
-	return s, nil
+	return nil
 }
 
-// Closes the listener and the server
+// Closes the listener and all connections right away, cutting off requests in flight.
+// Use Shutdown to let them finish.
 func (s *Server) Close() error {
 	// Mark the server as not running
-	s.State = false
+	s.closed.Store(true)
 
-	// Close the listener
-	if err := s.Listener.Close(); err != nil {
-		return err
-	}
+	err := s.closeListener()
+	s.cancelRequests()
+	s.closeAllConns()
+	return err
+}
 
-	return nil
+// Returns the context every request context derives from.
+func (s *Server) baseContext() context.Context {
+	s.baseOnce.Do(func() {
+		s.baseCtx, s.cancelBase = context.WithCancelCause(context.Background())
+	})
+	return s.baseCtx
+}
+
+// Cancels the context of every request in flight and of all that follow.
+func (s *Server) cancelRequests() {
+	s.baseContext()
+	s.cancelBase(ErrServerClosed)
+}
+
+// Returns the context for a request whose headers were just read. It ends with the
+// WriteTimeout, since no response can be written after that, and is cancelled through
+// cr.cancel when the client goes away or the request is over.
+func (s *Server) requestContext(cr *connReader) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancelCause(s.baseContext())
+	cr.cancel = cancel
+	if s.WriteTimeout <= 0 {
+		return ctx, func() { cancel(nil) }
+	}
+	ctx, stop := context.WithDeadline(ctx, deadline(cr.headersDone, s.WriteTimeout))
+	return ctx, func() {
+		stop()
+		cancel(nil)
+	}
 }
 
 // Uses a loop to .Accept new connections as they come in, and handles each one in a new goroutine.
 // I used an atomic.Bool to track whether the server is closed or not so that I can ignore connection errors after the server is closed.
 func (s *Server) listen() {
-	for s.State {
+	defer close(s.listenDone)
+	for {
 		conn, err := s.Listener.Accept()
 		if err != nil {
-			if !s.State {
+			if s.closed.Load() {
 				return
 			}
-			log.Printf("Error accepting connection: %v", err)
+			s.logf("Error accepting connection: %v", err)
 			continue
 		}
-		go s.handle(conn) // Handle each connection in a new goroutine
+		if s.TLSConfig != nil {
+			// The handshake happens on the first read, in the connection's own goroutine
+			conn = tls.Server(conn, s.TLSConfig)
+		}
+		s.trackConn(conn)
+		go s.handle(conn, s.nextConnID.Add(1)) // Handle each connection in a new goroutine
 	}
-
 }
 
-// Handles a single connection by writing the following response and then closing the connection:
-func (s *Server) handle(conn net.Conn) {
+// Handles a connection by serving requests on it until either side asks to close,
+// the per-connection request limit is reached or the connection sits idle too long.
+func (s *Server) handle(conn net.Conn, connID uint64) {
+	defer s.untrackConn(conn)
 	defer conn.Close()
+	// Whatever goes wrong on one connection must not take down the others
+	defer func() {
+		if rec := recover(); rec != nil {
+			s.logf("Panic on connection from %s: %v\n%s", conn.RemoteAddr(), rec, debug.Stack())
+		}
+	}()
 
-	req, err := request.RequestFromReader(conn)
-	if err != nil {
-		fmt.Fprint(conn, "HTTP/1.1 400 Bad Request\r\n\r\nMalformed request")
+	if tc, ok := conn.(*tls.Conn); ok && !s.handshake(tc) {
 		return
 	}
 
-	// var buf bytes.Buffer
-	writer := &response.Writer{}
+	// One parser per connection keeps bytes of pipelined requests between iterations.
+	// Requests are answered strictly in order since the next one is only parsed once the
+	// previous response has been written.
+	var tlsInfo *request.TLSInfo // Same for every request on the connection
+	cr := &connReader{s: s, conn: conn}
+	parser := request.NewParser(cr)
+	parser.StreamBody = s.StreamRequestBody
+	parser.Limits = s.Limits
+	parser.OnHeaders = func(req *request.Request) {
+		cr.headersDone = time.Now()
+		// The header timeout is over, the rest of the request gets what's left of ReadTimeout
+		conn.SetReadDeadline(deadline(cr.start, s.ReadTimeout))
+		// Counted from here for the whole response, however long the body takes to arrive
+		conn.SetWriteDeadline(deadline(cr.headersDone, s.WriteTimeout))
+	}
+	parser.OnBodyDone = func(req *request.Request) {
+		// Bytes already buffered belong to a pipelined request, so the client is still there
+		if cr.cancel != nil && parser.Buffered() == 0 {
+			cr.startBackgroundRead()
+		}
+	}
 
-	s.Handler(writer, req)
+	for served := 0; ; served++ {
+		if parser.Buffered() > 0 || cr.pending() {
+			// A pipelined request already in the buffer is as good as being read
+			cr.startRequest(time.Now())
+		} else {
+			if s.closed.Load() {
+				return
+			}
+			// Between requests the connection is idle; don't let it hold a goroutine forever
+			cr.waitRequest()
+		}
 
-	// Write statusline
-	conn.Write(writer.AssembleResponse())
+		req, err := parser.Next()
+		if err != nil {
+			var parseErr *request.ParseError
+			if errors.As(err, &parseErr) {
+				writeParseError(conn, parseErr)
+				lingeringClose(conn)
+			} else if errors.Is(err, os.ErrDeadlineExceeded) && !cr.start.IsZero() {
+				// Only part of the request made it in time. An idle connection timing out
+				// is closed silently, the client may be about to reuse it.
+				writeConnError(conn, response.RequestTimeout, "request timed out")
+				lingeringClose(conn)
+			}
+			// Otherwise the peer went away, idled out or broke mid-request; nothing to answer
+			return
+		}
+		ctx, cancel := s.requestContext(cr)
+		req.SetContext(ctx)
+		if req.BodyComplete() {
+			parser.OnBodyDone(req)
+		}
+		req.RemoteAddr = remoteAddr(conn)
+		req.Conn = &request.ConnInfo{
+			RemoteAddr:  conn.RemoteAddr(),
+			LocalAddr:   conn.LocalAddr(),
+			ID:          connID,
+			Seq:         served + 1,
+			FirstByte:   cr.start,
+			HeadersDone: cr.headersDone,
+		}
+		if tc, ok := conn.(*tls.Conn); ok {
+			if tlsInfo == nil {
+				tlsInfo = request.NewTLSInfo(tc.ConnectionState())
+			}
+			req.TLS = tlsInfo
+		}
+
+		writer := response.NewWriter(conn)
+		writer.OmitBody = req.RequestLine.Method == "HEAD"
+		if s.closeAfter(req, served+1) {
+			writer.CloseAfterResponse()
+		}
+
+		ok := s.serveRequest(conn, writer, req)
+		if ok {
+			// Write whatever the handler left out and flush it to the client
+			ok = writer.Finish() == nil && writer.KeepAlive()
+		} else {
+			abortConn(conn)
+		}
+		cancel()
+		cr.cancel = nil
+		cr.abortBackgroundRead()
+		if !ok {
+			return
+		}
+	}
+}
+
+// Runs the configured handler for one request. Reports false if the handler panicked
+// after the response was started, in which case the connection has to be dropped.
+func (s *Server) serveRequest(conn net.Conn, w *response.Writer, req *request.Request) (ok bool) {
+	defer func() {
+		if req.MultipartForm != nil {
+			req.MultipartForm.RemoveAll()
+		}
+	}()
+	defer func() {
+		if rec := recover(); rec != nil {
+			ok = s.handlePanic(conn, w, req, rec)
+		}
+	}()
+
+	if s.ErrorHandler == nil {
+		s.Handler(w, req)
+		return true
+	}
+	if err := s.ErrorHandler(w, req); err != nil {
+		s.handleError(w, req, err)
+	}
+	return true
+}
+
+// Logs a handler panic and answers with a 500 if the response hasn't been started yet.
+// The connection is closed afterwards either way since the handler may have left the
+// request body half read.
+func (s *Server) handlePanic(conn net.Conn, w *response.Writer, req *request.Request, rec any) bool {
+	if rec == ErrAbortHandler {
+		return false
+	}
+	stack := debug.Stack()
+	s.logf("Panic serving %s %s for %s: %v\n%s", req.RequestLine.Method, req.RequestLine.RequestTarget, conn.RemoteAddr(), rec, stack)
+	if s.PanicHook != nil {
+		s.PanicHook(req, rec, stack)
+	}
+
+	if w.Written() {
+		return false
+	}
+	w.CloseAfterResponse()
+	s.handleError(w, req, &HandlerError{StatusCode: response.InternalError})
+	return true
+}
+
+// Decides before the handler runs whether the connection has to close after answering req.
+// The response itself can still ask for close, see response.Writer.KeepAlive.
+func (s *Server) closeAfter(req *request.Request, served int) bool {
+	if s.closed.Load() {
+		// Shutting down, this is the last request on the connection
+		return true
+	}
+	if served >= s.maxRequestsPerConn() {
+		return true
+	}
+	return req.Headers.HasToken("Connection", "close")
+}
+
+// Runs the TLS handshake under a deadline of its own, its bytes never reach connReader and
+// so aren't covered by the request timeouts. Reports whether it succeeded.
+func (s *Server) handshake(tc *tls.Conn) bool {
+	timeout := s.readHeaderTimeout()
+	if timeout <= 0 {
+		timeout = s.idleTimeout()
+	}
+	tc.SetDeadline(time.Now().Add(timeout))
+	if err := tc.HandshakeContext(s.baseContext()); err != nil {
+		s.logf("TLS handshake error from %s: %v", tc.RemoteAddr(), err)
+		return false
+	}
+	tc.SetDeadline(time.Time{})
+	return true
+}
+
+func (s *Server) maxRequestsPerConn() int {
+	if s.MaxRequestsPerConn > 0 {
+		return s.MaxRequestsPerConn
+	}
+	return DefaultMaxRequestsPerConn
+}
+
+func (s *Server) idleTimeout() time.Duration {
+	if s.IdleTimeout > 0 {
+		return s.IdleTimeout
+	}
+	return DefaultIdleTimeout
+}
+
+func (s *Server) readHeaderTimeout() time.Duration {
+	if s.ReadHeaderTimeout > 0 {
+		return s.ReadHeaderTimeout
+	}
+	return s.ReadTimeout
+}
 
+// Answers a request the parser refused. The connection is closed afterwards since we
+// can't tell where the next request would start.
+func writeParseError(conn net.Conn, err *request.ParseError) {
+	statusCode := response.BadRequest
+	switch {
+	case errors.Is(err, request.ErrRequestLineTooLong):
+		statusCode = response.URITooLong
+	case errors.Is(err, request.ErrHeaderTooLarge):
+		statusCode = response.RequestHeaderFieldsTooLarge
+	case errors.Is(err, request.ErrBodyTooLarge):
+		statusCode = response.ContentTooLarge
+	case errors.Is(err, request.ErrUnsupportedVersion):
+		statusCode = response.HTTPVersionNotSupported
+	case errors.Is(err, request.ErrUnsupportedTransferCoding):
+		statusCode = response.NotImplemented
+	}
+
+	writeConnError(conn, statusCode, err.Error())
+}
+
+// Writes a plain text error response that ends the connection, for errors that happen
+// before there is a request to hand to the ErrorRenderer.
+func writeConnError(conn net.Conn, statusCode response.StatusCode, msg string) {
+	// Don't let a client that stopped reading hold us up
+	conn.SetWriteDeadline(time.Now().Add(time.Second))
+
+	body := []byte(msg)
+	w := response.NewWriter(conn)
+	w.CloseAfterResponse()
+	w.WriteStatusLine(statusCode)
+	w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+	w.WriteBody(body)
+	w.Finish()
+}
+
+func (s *Server) logf(format string, args ...any) {
+	if s.Logger != nil {
+		s.Logger.Printf(format, args...)
+		return
+	}
+	log.Printf(format, args...)
+}
+
+// Drops the connection with a RST instead of a regular close, so a client can't mistake a
+// response cut short for a complete one. Whatever is still buffered in the Writer is lost.
+func abortConn(conn net.Conn) {
+	if tc, ok := conn.(*tls.Conn); ok {
+		conn = tc.NetConn()
+	}
+	if tc, ok := conn.(*net.TCPConn); ok {
+		tc.SetLinger(0)
+	}
+	conn.Close()
+}
+
+// Closes our side for writing and briefly drains what the client is still sending. Closing
+// with unread data in the socket makes the kernel send a RST, which can make the client
+// drop the error response we just wrote.
+func lingeringClose(conn net.Conn) {
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+	}
+	conn.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+	io.CopyN(io.Discard, conn, 256<<10)
 }
@@ -0,0 +1,990 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/boxy-pug/httpfromtcp/internal/headers"
+	"github.com/boxy-pug/httpfromtcp/internal/request"
+	"github.com/boxy-pug/httpfromtcp/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newRequest(t *testing.T, raw string) *request.Request {
+	t.Helper()
+	req, err := request.RequestFromReader(strings.NewReader(raw))
+	require.NoError(t, err)
+	return req
+}
+
+func TestNegotiate(t *testing.T) {
+	offers := []string{"text/plain", "text/html", "application/problem+json", "application/json"}
+
+	// Test: No preference
+	assert.Equal(t, "text/plain", negotiate("", offers))
+	assert.Equal(t, "text/plain", negotiate("*/*", offers))
+
+	// Test: Browser style header
+	assert.Equal(t, "text/html", negotiate("text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8", offers))
+
+	// Test: Quality values
+	assert.Equal(t, "application/json", negotiate("text/html;q=0.5, application/json", offers))
+	assert.Equal(t, "text/html", negotiate("text/*;q=0.3, text/html;q=0.7, */*;q=0.1", offers))
+
+	// Test: Excluded types and nothing acceptable
+	assert.Equal(t, "text/html", negotiate("text/plain;q=0, text/*", offers))
+	assert.Equal(t, "", negotiate("image/png", offers))
+}
+
+func TestHandleError(t *testing.T) {
+	render := func(s *Server, raw string, err error) string {
+		var buf bytes.Buffer
+		w := response.NewWriter(&buf)
+		s.handleError(w, newRequest(t, raw), err)
+		require.NoError(t, w.Finish())
+		return buf.String()
+	}
+	s := &Server{}
+
+	// Test: HandlerError as plain text
+	out := render(s, "GET /missing HTTP/1.1\r\nHost: localhost\r\n\r\n", &HandlerError{StatusCode: response.NotFound, Message: "no such thing"})
+	assert.Equal(t, "HTTP/1.1 404 Not Found\r\nContent-Length: 14\r\nContent-Type: text/plain\r\n\r\nno such thing\n", out)
+
+	// Test: Wrapped HandlerError as problem details
+	err := fmt.Errorf("loading user: %w", &HandlerError{StatusCode: response.Forbidden, Message: "not yours"})
+	out = render(s, "GET /users/7 HTTP/1.1\r\nAccept: application/json\r\n\r\n", err)
+	assert.Contains(t, out, "HTTP/1.1 403 Forbidden\r\n")
+	assert.Contains(t, out, "Content-Type: application/problem+json\r\n")
+	assert.True(t, strings.HasSuffix(out, `{"type":"about:blank","title":"Forbidden","status":403,"detail":"not yours","instance":"/users/7"}`))
+
+	// Test: HTML is escaped
+	out = render(s, "GET / HTTP/1.1\r\nAccept: text/html\r\n\r\n", &HandlerError{StatusCode: response.BadRequest, Message: "<script>"})
+	assert.Contains(t, out, "Content-Type: text/html\r\n")
+	assert.Contains(t, out, "<title>400 Bad Request</title>")
+	assert.Contains(t, out, "<p>&lt;script&gt;</p>")
+
+	// Test: Other errors don't leak their message
+	out = render(s, "GET / HTTP/1.1\r\n\r\n", errors.New("database password is hunter2"))
+	assert.Equal(t, "HTTP/1.1 500 Internal Server Error\r\nContent-Length: 22\r\nContent-Type: text/plain\r\n\r\nInternal Server Error\n", out)
+
+	// Test: Invalid status code becomes 500
+	out = render(s, "GET / HTTP/1.1\r\n\r\n", &HandlerError{StatusCode: response.OK})
+	assert.Contains(t, out, "HTTP/1.1 500 Internal Server Error\r\n")
+
+	// Test: Extra headers, without overriding the framing
+	allow := headers.NewHeaders()
+	allow.Set("Allow", "GET, HEAD")
+	allow.Set("Content-Length", "99")
+	out = render(s, "DELETE / HTTP/1.1\r\n\r\n", &HandlerError{StatusCode: response.MethodNotAllowed, Headers: allow})
+	assert.Equal(t, "HTTP/1.1 405 Method Not Allowed\r\nAllow: GET, HEAD\r\nContent-Length: 19\r\nContent-Type: text/plain\r\n\r\nMethod Not Allowed\n", out)
+
+	// Test: Custom renderer
+	s = &Server{ErrorRenderer: func(w *response.Writer, req *request.Request, err *HandlerError) {
+		w.WriteStatusLine(err.StatusCode)
+		w.WriteHeaders(response.GetDefaultHeaders(0))
+	}}
+	out = render(s, "GET / HTTP/1.1\r\n\r\n", &HandlerError{StatusCode: response.Conflict})
+	assert.Equal(t, "HTTP/1.1 409 Conflict\r\nContent-Length: 0\r\nContent-Type: text/plain\r\n\r\n", out)
+
+	// Test: Response already started
+	var buf bytes.Buffer
+	w := response.NewWriter(&buf)
+	w.WriteStatusLine(response.OK)
+	s.handleError(w, newRequest(t, "GET / HTTP/1.1\r\n\r\n"), errors.New("late"))
+	w.Finish()
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nContent-Length: 0\r\nContent-Type: text/plain\r\n\r\n", buf.String())
+}
+
+// Runs s.handle on one end of a pipe, sends raw on the other and returns everything the
+// server wrote until it closed the connection.
+func roundTrip(t *testing.T, s *Server, raw string) string {
+	t.Helper()
+	client, conn := net.Pipe()
+	go s.handle(conn, 1)
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	go client.Write([]byte(raw))
+	out, err := io.ReadAll(client)
+	require.NoError(t, err)
+	return string(out)
+}
+
+func TestKeepAlive(t *testing.T) {
+	s := &Server{
+		MaxRequestsPerConn: 2,
+		IdleTimeout:        100 * time.Millisecond,
+		Handler: func(w *response.Writer, req *request.Request) {
+			body := req.URL.Path
+			w.WriteStatusLine(response.OK)
+			w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+			w.WriteBody([]byte(body))
+		},
+	}
+	const ok = "HTTP/1.1 200 OK\r\nContent-Length: 2\r\nContent-Type: text/plain\r\n"
+
+	// Test: Requests share the connection until MaxRequestsPerConn, the last one announces
+	// the close and anything after it goes unanswered
+	out := roundTrip(t, s, "GET /a HTTP/1.1\r\n\r\nGET /b HTTP/1.1\r\n\r\nGET /c HTTP/1.1\r\n\r\n")
+	assert.Equal(t, ok+"\r\n/a"+ok+"Connection: close\r\n\r\n/b", out)
+
+	// Test: Connection: close from the client
+	out = roundTrip(t, s, "GET /a HTTP/1.1\r\nConnection: close\r\n\r\nGET /b HTTP/1.1\r\n\r\n")
+	assert.Equal(t, ok+"Connection: close\r\n\r\n/a", out)
+
+	// Test: A kept-alive connection is closed once it sits idle for IdleTimeout
+	start := time.Now()
+	out = roundTrip(t, s, "GET /a HTTP/1.1\r\n\r\n")
+	assert.Equal(t, ok+"\r\n/a", out)
+	assert.GreaterOrEqual(t, time.Since(start), 100*time.Millisecond)
+}
+
+func TestHandlerPanic(t *testing.T) {
+	var hookValue any
+	s := &Server{
+		Handler: func(w *response.Writer, req *request.Request) {
+			switch req.URL.Path {
+			case "/early":
+				panic("boom")
+			case "/late":
+				w.WriteStatusLine(response.OK)
+				w.WriteHeaders(response.GetDefaultHeaders(10))
+				w.WriteBody([]byte("hello"))
+				w.Flush()
+				panic("boom")
+			case "/abort":
+				panic(ErrAbortHandler)
+			}
+		},
+		PanicHook: func(req *request.Request, recovered any, stack []byte) {
+			hookValue = recovered
+			assert.NotEmpty(t, stack)
+		},
+	}
+
+	// Test: Panic before anything was written becomes a 500 and closes the connection
+	out := roundTrip(t, s, "GET /early HTTP/1.1\r\n\r\nGET / HTTP/1.1\r\n\r\n")
+	assert.Equal(t, "HTTP/1.1 500 Internal Server Error\r\nContent-Length: 22\r\nContent-Type: text/plain\r\nConnection: close\r\n\r\nInternal Server Error\n", out)
+	assert.Equal(t, "boom", hookValue)
+
+	// Test: Panic after the response started cuts the connection
+	out = roundTrip(t, s, "GET /late HTTP/1.1\r\n\r\n")
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nContent-Length: 10\r\nContent-Type: text/plain\r\n\r\nhello", out)
+
+	// Test: ErrAbortHandler is not reported
+	hookValue = nil
+	out = roundTrip(t, s, "GET /abort HTTP/1.1\r\n\r\n")
+	assert.Equal(t, "", out)
+	assert.Nil(t, hookValue)
+
+	// Test: Other requests are unaffected
+	out = roundTrip(t, s, "GET / HTTP/1.1\r\nConnection: close\r\n\r\n")
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nContent-Length: 0\r\nContent-Type: text/plain\r\nConnection: close\r\n\r\n", out)
+}
+
+func TestHeadRequest(t *testing.T) {
+	s := &Server{Handler: func(w *response.Writer, req *request.Request) {
+		w.WriteStatusLine(response.OK)
+		w.WriteHeaders(response.GetDefaultHeaders(5))
+		w.WriteBody([]byte("hello"))
+	}}
+
+	// Test: Same headers as GET, no body, and the connection stays usable
+	out := roundTrip(t, s, "HEAD / HTTP/1.1\r\n\r\nGET / HTTP/1.1\r\nConnection: close\r\n\r\n")
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nContent-Length: 5\r\nContent-Type: text/plain\r\n\r\n"+
+		"HTTP/1.1 200 OK\r\nContent-Length: 5\r\nContent-Type: text/plain\r\nConnection: close\r\n\r\nhello", out)
+}
+
+func TestShutdown(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{}, 1)
+	s := &Server{Handler: func(w *response.Writer, req *request.Request) {
+		if req.URL.Path == "/slow" {
+			started <- struct{}{}
+			<-release
+		}
+		w.WriteStatusLine(response.OK)
+		w.WriteHeaders(response.GetDefaultHeaders(2))
+		w.WriteBody([]byte("ok"))
+	}}
+	require.NoError(t, s.Start(0))
+	addr := s.Listener.Addr().String()
+
+	// Idle keep-alive connection
+	idle, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer idle.Close()
+	idle.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+	buf := make([]byte, 1024)
+	idle.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := idle.Read(buf)
+	require.NoError(t, err)
+	assert.Contains(t, string(buf[:n]), "HTTP/1.1 200 OK")
+
+	// Connection with a request in flight
+	busy, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer busy.Close()
+	busy.Write([]byte("GET /slow HTTP/1.1\r\n\r\n"))
+	<-started
+
+	shutdownErr := make(chan error)
+	go func() {
+		shutdownErr <- s.Shutdown(context.Background())
+	}()
+
+	// Test: Idle connection is closed right away
+	_, err = idle.Read(buf)
+	assert.ErrorIs(t, err, io.EOF)
+
+	// Test: No new connections
+	time.Sleep(2 * shutdownPollInterval)
+	_, err = net.Dial("tcp", addr)
+	assert.Error(t, err)
+
+	// Test: Shutdown waits for the request in flight and closes the connection after it
+	select {
+	case <-shutdownErr:
+		t.Fatal("Shutdown returned with a request in flight")
+	default:
+	}
+	close(release)
+	busy.SetReadDeadline(time.Now().Add(5 * time.Second))
+	out, err := io.ReadAll(busy)
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nContent-Length: 2\r\nContent-Type: text/plain\r\n\r\nok", string(out))
+	assert.NoError(t, <-shutdownErr)
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	started := make(chan struct{})
+	s := &Server{Handler: func(w *response.Writer, req *request.Request) {
+		close(started)
+		<-release
+	}}
+	require.NoError(t, s.Start(0))
+
+	conn, err := net.Dial("tcp", s.Listener.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+	<-started
+
+	// Test: Connections still busy at the deadline are closed
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, s.Shutdown(ctx), context.DeadlineExceeded)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	out, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.Empty(t, out)
+}
+
+func TestTimeouts(t *testing.T) {
+	s := &Server{
+		IdleTimeout:       200 * time.Millisecond,
+		ReadHeaderTimeout: 200 * time.Millisecond,
+		ReadTimeout:       time.Second,
+		Handler: func(w *response.Writer, req *request.Request) {
+			w.WriteStatusLine(response.OK)
+			w.WriteHeaders(response.GetDefaultHeaders(len(req.Body)))
+			w.WriteBody(req.Body)
+		},
+	}
+	require.NoError(t, s.Start(0))
+	defer s.Close()
+	dial := func() net.Conn {
+		conn, err := net.Dial("tcp", s.Listener.Addr().String())
+		require.NoError(t, err)
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		return conn
+	}
+
+	// Test: Idle connection is closed without a response
+	conn := dial()
+	defer conn.Close()
+	out, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.Empty(t, out)
+
+	// Test: Slow headers get a 408
+	conn = dial()
+	defer conn.Close()
+	conn.Write([]byte("GET / HTTP/1.1\r\nHost: x\r\n"))
+	out, err = io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 408 Request Timeout\r\nContent-Length: 17\r\nContent-Type: text/plain\r\nConnection: close\r\n\r\nrequest timed out", string(out))
+
+	// Test: The body may take longer than the header timeout, within ReadTimeout
+	conn = dial()
+	defer conn.Close()
+	conn.Write([]byte("POST / HTTP/1.1\r\nContent-Length: 4\r\n\r\nab"))
+	time.Sleep(400 * time.Millisecond)
+	conn.Write([]byte("cd"))
+	buf := make([]byte, 1024)
+	n, err := conn.Read(buf)
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nContent-Length: 4\r\nContent-Type: text/plain\r\n\r\nabcd", string(buf[:n]))
+
+	// Test: ReadTimeout covers the whole request
+	conn = dial()
+	defer conn.Close()
+	conn.Write([]byte("POST / HTTP/1.1\r\nContent-Length: 4\r\n\r\nab"))
+	out, err = io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.Contains(t, string(out), "HTTP/1.1 408 Request Timeout\r\n")
+
+	s = &Server{
+		ReadTimeout:  2 * time.Second,
+		WriteTimeout: 300 * time.Millisecond,
+		Handler: func(w *response.Writer, req *request.Request) {
+			if req.URL.Path == "/slow" {
+				time.Sleep(400 * time.Millisecond)
+			}
+			w.WriteStatusLine(response.OK)
+			w.WriteHeaders(response.GetDefaultHeaders(len(req.Body)))
+			w.WriteBody(req.Body)
+		},
+	}
+	require.NoError(t, s.Start(0))
+	defer s.Close()
+
+	// Test: Response written within WriteTimeout
+	conn = dial()
+	defer conn.Close()
+	conn.Write([]byte("POST / HTTP/1.1\r\nContent-Length: 2\r\nConnection: close\r\n\r\nok"))
+	out, err = io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nContent-Length: 2\r\nContent-Type: text/plain\r\nConnection: close\r\n\r\nok", string(out))
+
+	// Test: Handler too slow for WriteTimeout, the response never makes it out
+	conn = dial()
+	defer conn.Close()
+	conn.Write([]byte("GET /slow HTTP/1.1\r\n\r\n"))
+	out, err = io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.Empty(t, out)
+
+	// Test: WriteTimeout counts from the end of the headers, a slow body uses it up
+	conn = dial()
+	defer conn.Close()
+	conn.Write([]byte("POST / HTTP/1.1\r\nContent-Length: 4\r\n\r\nab"))
+	time.Sleep(400 * time.Millisecond)
+	conn.Write([]byte("cd"))
+	out, err = io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.Empty(t, out)
+}
+
+func TestListen(t *testing.T) {
+	hello := func(w *response.Writer, req *request.Request) {
+		w.WriteStatusLine(response.OK)
+		w.WriteHeaders(response.GetDefaultHeaders(5))
+		w.WriteBody([]byte("hello"))
+	}
+	get := func(network, addr string) string {
+		conn, err := net.Dial(network, addr)
+		require.NoError(t, err)
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		conn.Write([]byte("GET / HTTP/1.1\r\nConnection: close\r\n\r\n"))
+		out, err := io.ReadAll(conn)
+		require.NoError(t, err)
+		return string(out)
+	}
+
+	// Test: Options
+	var logs bytes.Buffer
+	s := New(
+		WithAddr("127.0.0.1:0"),
+		WithHandler(hello),
+		WithIdleTimeout(time.Second),
+		WithLogger(log.New(&logs, "", 0)),
+	)
+	assert.Equal(t, time.Second, s.IdleTimeout)
+	require.NoError(t, s.Listen())
+	assert.Contains(t, get("tcp", s.Listener.Addr().String()), "\r\n\r\nhello")
+	s.Close()
+
+	// Test: Errors go to the configured logger
+	s.handleError(response.NewWriter(io.Discard), newRequest(t, "GET /x HTTP/1.1\r\n\r\n"), errors.New("oops"))
+	assert.Equal(t, "Error handling GET /x: oops\n", logs.String())
+
+	// Test: Caller's listener
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s = New(WithHandler(hello))
+	require.NoError(t, s.ServeListener(l))
+	assert.Contains(t, get("tcp", l.Addr().String()), "\r\n\r\nhello")
+	assert.Error(t, s.ServeListener(l))
+	s.Close()
+
+	// Test: No handler
+	l, err = net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	assert.Error(t, New().ServeListener(l))
+
+	// Test: IPv6
+	s = New(WithNetwork("tcp6"), WithAddr("[::1]:0"), WithHandler(hello))
+	if err := s.Listen(); err != nil {
+		t.Logf("skipping IPv6: %v", err)
+	} else {
+		assert.Contains(t, get("tcp6", s.Listener.Addr().String()), "\r\n\r\nhello")
+		s.Close()
+	}
+
+	// Test: Unix socket
+	path := filepath.Join(t.TempDir(), "server.sock")
+	s = New(WithNetwork("unix"), WithAddr(path), WithHandler(hello))
+	require.NoError(t, s.Listen())
+	assert.Contains(t, get("unix", path), "\r\n\r\nhello")
+	s.Close()
+}
+
+func TestUnixSocket(t *testing.T) {
+	var remote string
+	handler := WithHandler(func(w *response.Writer, req *request.Request) {
+		remote = req.RemoteAddr
+	})
+	get := func(addr string) string {
+		conn, err := net.Dial("unix", addr)
+		require.NoError(t, err)
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		conn.Write([]byte("GET / HTTP/1.1\r\nConnection: close\r\n\r\n"))
+		out, err := io.ReadAll(conn)
+		require.NoError(t, err)
+		return string(out)
+	}
+	dir := t.TempDir()
+
+	// Test: Mode, ownership and remote address
+	path := filepath.Join(dir, "server.sock")
+	s := New(WithNetwork("unix"), WithAddr(path), WithUnixSocketMode(0o600),
+		WithUnixSocketOwner(strconv.Itoa(os.Getuid()), strconv.Itoa(os.Getgid())), handler)
+	require.NoError(t, s.Listen())
+	fi, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o600), fi.Mode().Perm())
+	assert.Contains(t, get(path), "HTTP/1.1 200 OK\r\n")
+	assert.Equal(t, "unix:"+path, remote)
+
+	// Test: The socket file is private until mode and owner are applied
+	l, _, err := listenUnixPrivate(filepath.Join(dir, "private.sock"))
+	require.NoError(t, err)
+	fi, err = os.Stat(filepath.Join(dir, "private.sock"))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o600), fi.Mode().Perm())
+	l.Close()
+	wide := New(WithNetwork("unix"), WithAddr(filepath.Join(dir, "wide.sock")), WithUnixSocketMode(0o666), handler)
+	require.NoError(t, wide.Listen())
+	fi, err = os.Stat(filepath.Join(dir, "wide.sock"))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o666), fi.Mode().Perm())
+	wide.Close()
+
+	// Test: Socket in use is not taken over
+	assert.Error(t, New(WithNetwork("unix"), WithAddr(path), handler).Listen())
+	s.Close()
+	_, err = os.Stat(path)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	// Test: Stale socket file is replaced
+	l, err = net.Listen("unix", path)
+	require.NoError(t, err)
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	l.Close()
+	_, err = os.Stat(path)
+	require.NoError(t, err)
+	s = New(WithNetwork("unix"), WithAddr(path), handler)
+	require.NoError(t, s.Listen())
+	assert.Contains(t, get(path), "HTTP/1.1 200 OK\r\n")
+	s.Close()
+
+	// Test: Other files are never removed
+	path = filepath.Join(dir, "regular")
+	require.NoError(t, os.WriteFile(path, []byte("data"), 0o644))
+	assert.Error(t, New(WithNetwork("unix"), WithAddr(path), handler).Listen())
+	_, err = os.Stat(path)
+	assert.NoError(t, err)
+
+	// Test: Unknown owner
+	path = filepath.Join(dir, "owned.sock")
+	assert.Error(t, New(WithNetwork("unix"), WithAddr(path), WithUnixSocketOwner("no-such-user-here", ""), handler).Listen())
+
+	// Test: Abstract socket
+	if runtime.GOOS == "linux" {
+		name := fmt.Sprintf("@httpfromtcp-test-%d", os.Getpid())
+		s = New(WithNetwork("unix"), WithAddr(name), handler)
+		require.NoError(t, s.Listen())
+		assert.Contains(t, get(name), "HTTP/1.1 200 OK\r\n")
+		assert.Equal(t, "unix:"+name, remote)
+		s.Close()
+	}
+}
+
+// Set for the copy of the test binary TestUpgrade starts, see TestMain
+const envUpgradeTestChild = "HTTPFROMTCP_TEST_UPGRADE_CHILD"
+
+func TestMain(m *testing.M) {
+	if mode := os.Getenv(envUpgradeTestChild); mode != "" {
+		runUpgradeChild(mode)
+		return
+	}
+	os.Exit(m.Run())
+}
+
+// Plays the new process of an Upgrade: serves on the inherited listener until asked to stop.
+func runUpgradeChild(mode string) {
+	if mode == "fail" {
+		os.Exit(1)
+	}
+	listeners, err := InheritedListeners()
+	if err != nil || len(listeners) != 1 {
+		log.Fatalf("inherited listeners: %v %v", listeners, err)
+	}
+	stop := make(chan struct{})
+	s := New(WithHandler(func(w *response.Writer, req *request.Request) {
+		body := []byte(fmt.Sprintf("child %d", os.Getpid()))
+		w.WriteStatusLine(response.OK)
+		w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+		w.WriteBody(body)
+		if req.URL.Path == "/stop" {
+			close(stop)
+		}
+	}))
+	if err := s.ServeListener(listeners[0]); err != nil {
+		log.Fatal(err)
+	}
+	if err := NotifyReady(); err != nil {
+		log.Fatal(err)
+	}
+	select {
+	case <-stop:
+	case <-time.After(10 * time.Second):
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	s.Shutdown(ctx)
+}
+
+func TestUpgrade(t *testing.T) {
+	get := func(addr, path string) string {
+		conn, err := net.Dial("tcp", addr)
+		require.NoError(t, err)
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		conn.Write([]byte("GET " + path + " HTTP/1.1\r\nConnection: close\r\n\r\n"))
+		out, err := io.ReadAll(conn)
+		require.NoError(t, err)
+		return string(out)
+	}
+
+	// Test: Nothing inherited
+	listeners, err := InheritedListeners()
+	require.NoError(t, err)
+	assert.Empty(t, listeners)
+
+	s := New(WithHandler(func(w *response.Writer, req *request.Request) {
+		w.WriteStatusLine(response.OK)
+		w.WriteHeaders(response.GetDefaultHeaders(6))
+		w.WriteBody([]byte("parent"))
+	}))
+	require.NoError(t, s.Start(0))
+	defer s.Close()
+	addr := s.Listener.Addr().String()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// Test: New process that never gets ready leaves the server running
+	t.Setenv(envUpgradeTestChild, "fail")
+	assert.Error(t, s.Upgrade(ctx))
+	assert.Contains(t, get(addr, "/"), "\r\n\r\nparent")
+
+	// Test: Handoff to a new process without losing the socket
+	t.Setenv(envUpgradeTestChild, "serve")
+	require.NoError(t, s.Upgrade(ctx))
+	require.NoError(t, s.Shutdown(ctx))
+	out := get(addr, "/")
+	assert.Contains(t, out, "\r\n\r\nchild ")
+	assert.NotContains(t, out, fmt.Sprintf("child %d", os.Getpid()))
+	get(addr, "/stop")
+}
+
+// Writes a self-signed certificate for names to dir and returns the files and the
+// certificate to trust it.
+func writeCert(t *testing.T, dir, prefix string, serial int64, names ...string) (CertificateFiles, *x509.Certificate) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(serial),
+		Subject:               pkix.Name{CommonName: names[0]},
+		DNSNames:              names,
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	files := CertificateFiles{CertFile: filepath.Join(dir, prefix+".crt"), KeyFile: filepath.Join(dir, prefix+".key")}
+	require.NoError(t, os.WriteFile(files.CertFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+	require.NoError(t, os.WriteFile(files.KeyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600))
+	return files, cert
+}
+
+func TestTLS(t *testing.T) {
+	dir := t.TempDir()
+	aFiles, aCert := writeCert(t, dir, "a", 1, "a.test")
+	bFiles, bCert := writeCert(t, dir, "b", 2, "*.b.test")
+	store, err := NewCertStore(aFiles, bFiles)
+	require.NoError(t, err)
+
+	// Test: Certificate selection by server name
+	pick := func(name string) int64 {
+		cert, err := store.GetCertificate(&tls.ClientHelloInfo{ServerName: name})
+		require.NoError(t, err)
+		return cert.Leaf.SerialNumber.Int64()
+	}
+	assert.Equal(t, int64(1), pick("a.test"))
+	assert.Equal(t, int64(2), pick("www.B.test"))
+	assert.Equal(t, int64(1), pick("x.www.b.test"))
+	assert.Equal(t, int64(1), pick(""))
+
+	s := New(WithTLSConfig(store.TLSConfig()), WithHandler(func(w *response.Writer, req *request.Request) {
+		w.WriteStatusLine(response.OK)
+		w.WriteHeaders(response.GetDefaultHeaders(6))
+		w.WriteBody([]byte("secure"))
+	}))
+	require.NoError(t, s.Start(0))
+	defer s.Close()
+	addr := s.Listener.Addr().String()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(aCert)
+	roots.AddCert(bCert)
+	dial := func(name string) *tls.Conn {
+		conn, err := tls.Dial("tcp", addr, &tls.Config{ServerName: name, RootCAs: roots})
+		require.NoError(t, err)
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		return conn
+	}
+	get := func(conn *tls.Conn) string {
+		conn.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+		buf := make([]byte, 1024)
+		n, err := conn.Read(buf)
+		require.NoError(t, err)
+		return string(buf[:n])
+	}
+
+	// Test: HTTPS with SNI
+	conn := dial("api.b.test")
+	defer conn.Close()
+	assert.Equal(t, int64(2), conn.ConnectionState().PeerCertificates[0].SerialNumber.Int64())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nContent-Length: 6\r\nContent-Type: text/plain\r\n\r\nsecure", get(conn))
+
+	// Test: Plain HTTP on the TLS port gets nowhere
+	plain, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer plain.Close()
+	plain.SetDeadline(time.Now().Add(5 * time.Second))
+	plain.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+	out, _ := io.ReadAll(plain)
+	assert.NotContains(t, string(out), "secure")
+
+	// Test: A stalled handshake gets ReadHeaderTimeout, not IdleTimeout
+	slow := New(WithTLSConfig(store.TLSConfig()), WithReadHeaderTimeout(100*time.Millisecond),
+		WithIdleTimeout(time.Minute), WithLogger(log.New(io.Discard, "", 0)), WithHandler(func(w *response.Writer, req *request.Request) {}))
+	require.NoError(t, slow.Start(0))
+	defer slow.Close()
+	stalled, err := net.Dial("tcp", slow.Listener.Addr().String())
+	require.NoError(t, err)
+	defer stalled.Close()
+	stalled.SetDeadline(time.Now().Add(5 * time.Second))
+	stalled.Write([]byte{0x16, 0x03, 0x01}) // Start of a ClientHello record
+	start := time.Now()
+	_, err = io.ReadAll(stalled)
+	require.NoError(t, err)
+	assert.Less(t, time.Since(start), 2*time.Second)
+
+	// Test: Reload swaps the certificate for new handshakes, open connections keep working
+	_, aCert2 := writeCert(t, dir, "a", 3, "a.test")
+	roots.AddCert(aCert2)
+	old := dial("a.test")
+	defer old.Close()
+	assert.Equal(t, int64(1), old.ConnectionState().PeerCertificates[0].SerialNumber.Int64())
+	require.NoError(t, store.Reload())
+	fresh := dial("a.test")
+	defer fresh.Close()
+	assert.Equal(t, int64(3), fresh.ConnectionState().PeerCertificates[0].SerialNumber.Int64())
+	assert.Contains(t, get(old), "secure")
+	assert.Contains(t, get(fresh), "secure")
+
+	// Test: Broken files keep the certificates in use
+	require.NoError(t, os.WriteFile(aFiles.KeyFile, []byte("garbage"), 0o600))
+	assert.Error(t, store.Reload())
+	assert.Equal(t, int64(3), pick("a.test"))
+
+	// Test: Watch picks up changed files
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go store.Watch(ctx, 10*time.Millisecond, nil)
+	writeCert(t, dir, "a", 4, "a.test")
+	assert.Eventually(t, func() bool { return pick("a.test") == 4 }, 5*time.Second, 10*time.Millisecond)
+}
+
+// Creates a self-signed client certificate carrying uris as SANs.
+func clientCert(t *testing.T, serial int64, uris ...string) (tls.Certificate, *x509.Certificate) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(serial),
+		Subject:               pkix.Name{CommonName: "client"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	for _, u := range uris {
+		parsed, err := url.Parse(u)
+		require.NoError(t, err)
+		template.URIs = append(template.URIs, parsed)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: cert}, cert
+}
+
+func TestMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	serverFiles, serverCert := writeCert(t, dir, "server", 1, "server.test")
+	store, err := NewCertStore(serverFiles)
+	require.NoError(t, err)
+	trusted, trustedCert := clientCert(t, 2, "spiffe://example.org/ns/prod/sa/api")
+	untrusted, _ := clientCert(t, 3, "spiffe://example.org/ns/prod/sa/api")
+
+	// Test: Client CAs from PEM files and policy names
+	caFile := filepath.Join(dir, "clients.pem")
+	require.NoError(t, os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: trustedCert.Raw}), 0o600))
+	pool, err := LoadCertPool(caFile)
+	require.NoError(t, err)
+	_, err = LoadCertPool(serverFiles.KeyFile)
+	assert.Error(t, err)
+	mode, err := ParseClientAuth("verify-if-given")
+	require.NoError(t, err)
+	assert.Equal(t, tls.VerifyClientCertIfGiven, mode)
+	_, err = ParseClientAuth("sometimes")
+	assert.Error(t, err)
+
+	start := func(mode tls.ClientAuthType) *Server {
+		config := store.TLSConfig()
+		config.ClientCAs = pool
+		config.ClientAuth = mode
+		s := New(WithTLSConfig(config), WithHandler(func(w *response.Writer, req *request.Request) {
+			body := []byte(fmt.Sprintf("%v|%s|%s|%s|%d", req.TLS.Verified, req.TLS.SPIFFEID, req.TLS.TrustDomain(),
+				req.TLS.VersionName(), len(req.TLS.PeerCertificates)))
+			w.WriteStatusLine(response.OK)
+			w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+			w.WriteBody(body)
+		}))
+		require.NoError(t, s.Start(0))
+		t.Cleanup(func() { s.Close() })
+		return s
+	}
+	s := start(mode)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(serverCert)
+	get := func(certs ...tls.Certificate) (string, error) {
+		conn, err := tls.Dial("tcp", s.Listener.Addr().String(), &tls.Config{ServerName: "server.test", RootCAs: roots, Certificates: certs})
+		if err != nil {
+			return "", err
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		conn.Write([]byte("GET / HTTP/1.1\r\nConnection: close\r\n\r\n"))
+		out, err := io.ReadAll(conn)
+		_, body, _ := strings.Cut(string(out), "\r\n\r\n")
+		return body, err
+	}
+
+	// Test: Verified client certificate and its SPIFFE ID
+	body, err := get(trusted)
+	require.NoError(t, err)
+	assert.Equal(t, "true|spiffe://example.org/ns/prod/sa/api|example.org|TLS 1.3|1", body)
+
+	// Test: No client certificate is fine in this mode
+	body, err = get()
+	require.NoError(t, err)
+	assert.Equal(t, "false|||TLS 1.3|0", body)
+
+	// Test: Untrusted certificate is refused
+	body, _ = get(untrusted)
+	assert.Empty(t, body)
+
+	// Test: Required certificate missing
+	s = start(tls.RequireAndVerifyClientCert)
+	body, _ = get()
+	assert.Empty(t, body)
+}
+
+func TestConnInfo(t *testing.T) {
+	infos := make(chan *request.ConnInfo, 3)
+	s := New(WithHandler(func(w *response.Writer, req *request.Request) {
+		infos <- req.Conn
+	}))
+	require.NoError(t, s.Start(0))
+	defer s.Close()
+
+	send := func(conn net.Conn, raw string) {
+		conn.Write([]byte(raw))
+		buf := make([]byte, 1024)
+		_, err := conn.Read(buf)
+		require.NoError(t, err)
+	}
+	first, err := net.Dial("tcp", s.Listener.Addr().String())
+	require.NoError(t, err)
+	defer first.Close()
+	first.SetDeadline(time.Now().Add(5 * time.Second))
+	second, err := net.Dial("tcp", s.Listener.Addr().String())
+	require.NoError(t, err)
+	defer second.Close()
+	second.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// Test: Addresses, arrival times and sequence on the connection
+	before := time.Now()
+	first.Write([]byte("GET / HTTP/1.1\r\n"))
+	time.Sleep(50 * time.Millisecond)
+	send(first, "Host: x\r\n\r\n")
+	info := <-infos
+	assert.Equal(t, first.LocalAddr().String(), info.RemoteAddr.String())
+	assert.Equal(t, first.RemoteAddr().String(), info.LocalAddr.String())
+	assert.Equal(t, "127.0.0.1", info.RemoteIP().String())
+	assert.Equal(t, 1, info.Seq)
+	assert.False(t, info.FirstByte.Before(before))
+	assert.GreaterOrEqual(t, info.HeadersDone.Sub(info.FirstByte), 50*time.Millisecond)
+	firstID := info.ID
+
+	send(first, "GET / HTTP/1.1\r\n\r\n")
+	info = <-infos
+	assert.Equal(t, firstID, info.ID)
+	assert.Equal(t, 2, info.Seq)
+
+	// Test: Each connection gets its own, increasing ID
+	send(second, "GET / HTTP/1.1\r\n\r\n")
+	info = <-infos
+	assert.Greater(t, info.ID, firstID)
+	assert.Equal(t, 1, info.Seq)
+}
+
+func TestRequestContext(t *testing.T) {
+	causes := make(chan error, 1)
+	contexts := make(chan context.Context, 2)
+	handler := func(w *response.Writer, req *request.Request) {
+		ctx := req.Context()
+		contexts <- ctx
+		switch req.URL.Path {
+		case "/wait":
+			io.ReadAll(req.BodyReader)
+			select {
+			case <-ctx.Done():
+				causes <- context.Cause(ctx)
+			case <-time.After(5 * time.Second):
+				causes <- nil
+			}
+		case "/slow":
+			time.Sleep(100 * time.Millisecond)
+			if ctx.Err() != nil {
+				w.WriteStatusLine(response.InternalError)
+			}
+		}
+	}
+	start := func(stream bool) *Server {
+		s := New(WithHandler(handler), WithStreamRequestBody(stream), WithWriteTimeout(time.Minute))
+		require.NoError(t, s.Start(0))
+		return s
+	}
+	dial := func(s *Server) net.Conn {
+		conn, err := net.Dial("tcp", s.Listener.Addr().String())
+		require.NoError(t, err)
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		return conn
+	}
+
+	for _, stream := range []bool{false, true} {
+		s := start(stream)
+		defer s.Close()
+
+		// Test: Client hanging up cancels the context, with or without a streamed body
+		conn := dial(s)
+		conn.Write([]byte("POST /wait HTTP/1.1\r\nContent-Length: 2\r\n\r\nhi"))
+		ctx := <-contexts
+		deadline, ok := ctx.Deadline()
+		assert.True(t, ok)
+		assert.WithinDuration(t, time.Now().Add(time.Minute), deadline, 5*time.Second)
+		conn.Close()
+		assert.Equal(t, ErrClientDisconnected, <-causes)
+	}
+
+	s := start(false)
+	defer s.Close()
+
+	// Test: Pipelined requests don't look like a disconnect, and their bytes aren't lost
+	conn := dial(s)
+	defer conn.Close()
+	conn.Write([]byte("GET /slow HTTP/1.1\r\n\r\n"))
+	ctx := <-contexts
+	conn.Write([]byte("GET /slow HTTP/1.1\r\n\r\nGET /slow HTTP/1.1\r\nConnection: close\r\n\r\n"))
+	out, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.Equal(t, 3, strings.Count(string(out), "HTTP/1.1 200 OK\r\n"))
+	<-contexts
+	<-contexts
+
+	// Test: The context ends with the request
+	assert.Equal(t, context.Canceled, ctx.Err())
+
+	// Test: Close cancels requests in flight
+	conn = dial(s)
+	defer conn.Close()
+	conn.Write([]byte("GET /wait HTTP/1.1\r\n\r\n"))
+	<-contexts
+	s.Close()
+	assert.Equal(t, ErrServerClosed, <-causes)
+}
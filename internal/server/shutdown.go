@@ -0,0 +1,104 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+)
+
+// How often Shutdown checks whether the remaining connections have finished
+const shutdownPollInterval = 50 * time.Millisecond
+
+type connState int
+
+const (
+	connStateIdle   connState = iota // Waiting for the next request, safe to close
+	connStateActive                  // Receiving a request or writing the response
+)
+
+// Stops the server gracefully: stops accepting connections, closes idle ones right away and
+// waits for the others to finish the request they are serving and closes them after it.
+// Connections still busy when ctx is done are closed forcibly, after cancelling the context of
+// their requests, and ctx's error is returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.closed.Store(true)
+	err := s.closeListener()
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		if s.closeIdleConns() {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			s.cancelRequests()
+			s.closeAllConns()
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Closes the listener and waits for the accept loop to return, so no connection can be
+// added after this.
+func (s *Server) closeListener() error {
+	if s.Listener == nil {
+		return nil
+	}
+	err := s.Listener.Close()
+	if s.listenDone != nil {
+		<-s.listenDone
+	}
+	if errors.Is(err, net.ErrClosed) {
+		// Closed before by Close or an earlier Shutdown
+		return nil
+	}
+	return err
+}
+
+func (s *Server) trackConn(conn net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conns == nil {
+		s.conns = make(map[net.Conn]connState)
+	}
+	s.conns[conn] = connStateIdle
+}
+
+func (s *Server) untrackConn(conn net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.conns, conn)
+}
+
+func (s *Server) setConnState(conn net.Conn, state connState) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.conns[conn]; ok {
+		s.conns[conn] = state
+	}
+}
+
+// Closes every idle connection and reports whether none are left.
+func (s *Server) closeIdleConns() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for conn, state := range s.conns {
+		if state == connStateIdle {
+			conn.Close()
+			delete(s.conns, conn)
+		}
+	}
+	return len(s.conns) == 0
+}
+
+func (s *Server) closeAllConns() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for conn := range s.conns {
+		conn.Close()
+		delete(s.conns, conn)
+	}
+}
@@ -0,0 +1,187 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// A certificate and its private key, both PEM encoded.
+type CertificateFiles struct {
+	CertFile string
+	KeyFile  string
+}
+
+// Serves TLS certificates loaded from files and picks one per handshake by the server name
+// the client asks for (SNI). Reload swaps in freshly loaded certificates at once; handshakes
+// already done keep theirs, so no connection is dropped.
+type CertStore struct {
+	files []CertificateFiles
+	certs atomic.Pointer[certSet]
+}
+
+type certSet struct {
+	byName map[string]*tls.Certificate // Lower case DNS names from the certificates, may be wildcards
+	first  *tls.Certificate            // For clients that don't send a name we have
+	stamps []fileStamp                 // State of the files when they were loaded, for Watch
+}
+
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+// Loads the certificates. The first one is used when no other matches the client's server name.
+func NewCertStore(files ...CertificateFiles) (*CertStore, error) {
+	if len(files) == 0 {
+		return nil, errors.New("server: no certificates")
+	}
+	c := &CertStore{files: files}
+	if err := c.Reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Loads all certificates again. If any of them fails to load the ones in use are kept.
+func (c *CertStore) Reload() error {
+	stamps, err := statFiles(c.files)
+	if err != nil {
+		return err
+	}
+	set := &certSet{byName: make(map[string]*tls.Certificate), stamps: stamps}
+	for _, f := range c.files {
+		cert, err := tls.LoadX509KeyPair(f.CertFile, f.KeyFile)
+		if err != nil {
+			return fmt.Errorf("server: loading %s: %w", f.CertFile, err)
+		}
+		if set.first == nil {
+			set.first = &cert
+		}
+		for _, name := range cert.Leaf.DNSNames {
+			name = strings.ToLower(name)
+			// An earlier certificate wins for a name several of them cover
+			if _, ok := set.byName[name]; !ok {
+				set.byName[name] = &cert
+			}
+		}
+	}
+	c.certs.Store(set)
+	return nil
+}
+
+// Picks the certificate for a handshake, for use as tls.Config.GetCertificate.
+func (c *CertStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	set := c.certs.Load()
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	if cert, ok := set.byName[name]; ok {
+		return cert, nil
+	}
+	// A wildcard only stands for the leftmost label
+	if _, parent, ok := strings.Cut(name, "."); ok {
+		if cert, ok := set.byName["*."+parent]; ok {
+			return cert, nil
+		}
+	}
+	return set.first, nil
+}
+
+// Returns a TLS configuration serving the store's certificates.
+func (c *CertStore) TLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: c.GetCertificate,
+	}
+}
+
+// Reads PEM encoded CA certificates, e.g. for tls.Config.ClientCAs to verify client
+// certificates against.
+func LoadCertPool(files ...string) (*x509.CertPool, error) {
+	pool := x509.NewCertPool()
+	for _, f := range files {
+		data, err := os.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("server: no certificates in %s", f)
+		}
+	}
+	return pool, nil
+}
+
+// Client certificate policies by name, for configuration files and flags
+var clientAuthTypes = map[string]tls.ClientAuthType{
+	"none":               tls.NoClientCert,
+	"request":            tls.RequestClientCert,
+	"require":            tls.RequireAnyClientCert,
+	"verify-if-given":    tls.VerifyClientCertIfGiven,
+	"require-and-verify": tls.RequireAndVerifyClientCert,
+}
+
+// Parses a client certificate policy: none, request, require, verify-if-given or
+// require-and-verify. Only the last two check certificates against the client CAs.
+func ParseClientAuth(name string) (tls.ClientAuthType, error) {
+	mode, ok := clientAuthTypes[name]
+	if !ok {
+		return 0, fmt.Errorf("server: unknown client auth mode %q", name)
+	}
+	return mode, nil
+}
+
+// Reloads the certificates whenever one of the files changes, checking every interval
+// until ctx is done. A failed reload is passed to onError, if set, and tried again on the
+// next check, e.g. when the certificate was replaced but the matching key not yet.
+func (c *CertStore) Watch(ctx context.Context, interval time.Duration, onError func(error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		stamps, err := statFiles(c.files)
+		if err == nil && equalStamps(stamps, c.certs.Load().stamps) {
+			continue
+		}
+		if err == nil {
+			err = c.Reload()
+		}
+		if err != nil && onError != nil {
+			onError(err)
+		}
+	}
+}
+
+func statFiles(files []CertificateFiles) ([]fileStamp, error) {
+	var stamps []fileStamp
+	for _, f := range files {
+		for _, path := range []string{f.CertFile, f.KeyFile} {
+			fi, err := os.Stat(path)
+			if err != nil {
+				return nil, err
+			}
+			stamps = append(stamps, fileStamp{modTime: fi.ModTime(), size: fi.Size()})
+		}
+	}
+	return stamps, nil
+}
+
+func equalStamps(a, b []fileStamp) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !a[i].modTime.Equal(b[i].modTime) || a[i].size != b[i].size {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,146 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"os/user"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Listens on a Unix domain socket. A path starting with "@" is a Linux abstract socket,
+// which has no file and so no permissions or stale file to deal with. For a path socket a
+// stale file from an earlier run is removed first. With a mode or owner configured the
+// file is created accessible to our own user only and opened up once both are applied,
+// so it is never reachable by anyone they don't allow.
+func (s *Server) listenUnix(path string) (net.Listener, error) {
+	if strings.HasPrefix(path, "@") {
+		if runtime.GOOS != "linux" {
+			return nil, errors.New("server: abstract sockets are only supported on Linux")
+		}
+		return net.Listen("unix", path)
+	}
+
+	if err := removeStaleSocket(path); err != nil {
+		return nil, err
+	}
+	if s.UnixSocketMode == 0 && s.UnixSocketOwner == "" && s.UnixSocketGroup == "" {
+		return net.Listen("unix", path)
+	}
+	uid, gid, err := lookupOwner(s.UnixSocketOwner, s.UnixSocketGroup)
+	if err != nil {
+		return nil, err
+	}
+	l, umask, err := listenUnixPrivate(path)
+	if err != nil {
+		return nil, err
+	}
+	mode := s.UnixSocketMode
+	if mode == 0 {
+		// What the socket would have got without the private umask
+		mode = 0o777 &^ umask
+	}
+	// Owner first, the mode may open the socket up to the new group
+	if uid != -1 || gid != -1 {
+		if err := os.Chown(path, uid, gid); err != nil {
+			l.Close()
+			return nil, err
+		}
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// Serializes changes to the umask, which is shared by the whole process
+var umaskMu sync.Mutex
+
+// Listens on a socket file only our own user can connect to and returns the umask that
+// was in effect before. Files other goroutines create meanwhile only end up stricter.
+func listenUnixPrivate(path string) (net.Listener, fs.FileMode, error) {
+	umaskMu.Lock()
+	defer umaskMu.Unlock()
+	old := syscall.Umask(0o177)
+	defer syscall.Umask(old)
+	l, err := net.Listen("unix", path)
+	return l, fs.FileMode(old), err
+}
+
+// Removes a socket file left behind by a process that didn't shut down cleanly. A socket
+// something still accepts on is left alone, so listening on it fails as address in use.
+func removeStaleSocket(path string) error {
+	fi, err := os.Lstat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if fi.Mode().Type() != fs.ModeSocket {
+		return fmt.Errorf("server: %s exists and is not a socket", path)
+	}
+
+	conn, err := net.DialTimeout("unix", path, time.Second)
+	if err == nil {
+		conn.Close()
+		return nil
+	}
+	if !errors.Is(err, syscall.ECONNREFUSED) {
+		// Can't tell whether it's stale, let Listen report the problem
+		return nil
+	}
+	return os.Remove(path)
+}
+
+// Resolves user and group names or numeric IDs. An empty name gives -1, which os.Chown
+// leaves unchanged.
+func lookupOwner(owner, group string) (uid, gid int, err error) {
+	uid, gid = -1, -1
+	if owner != "" {
+		if uid, err = strconv.Atoi(owner); err != nil {
+			u, err := user.Lookup(owner)
+			if err != nil {
+				return 0, 0, err
+			}
+			if uid, err = strconv.Atoi(u.Uid); err != nil {
+				return 0, 0, fmt.Errorf("server: user %s has no numeric uid", owner)
+			}
+		}
+	}
+	if group != "" {
+		if gid, err = strconv.Atoi(group); err != nil {
+			g, err := user.LookupGroup(group)
+			if err != nil {
+				return 0, 0, err
+			}
+			if gid, err = strconv.Atoi(g.Gid); err != nil {
+				return 0, 0, fmt.Errorf("server: group %s has no numeric gid", group)
+			}
+		}
+	}
+	return uid, gid, nil
+}
+
+// Returns the client address for Request.RemoteAddr. A client on a Unix socket usually
+// doesn't bind a name of its own, in that case the socket it connected to is reported
+// instead, prefixed with "unix:", so logs still show where the request came from.
+func remoteAddr(conn net.Conn) string {
+	addr := conn.RemoteAddr()
+	// Linux reports an unnamed peer as "@"
+	if addr == nil || addr.String() == "" || addr.String() == "@" {
+		if local := conn.LocalAddr(); local != nil && local.Network() == "unix" {
+			return "unix:" + local.String()
+		}
+		return ""
+	}
+	return addr.String()
+}